@@ -0,0 +1,737 @@
+// Package gatewayapi is a router.DataStore backed by Kubernetes Gateway
+// API resources (Gateway, HTTPRoute, TLSRoute, TCPRoute), so the router
+// can be driven directly by a cluster's Gateway configuration instead of
+// (or alongside) the controller's route API.
+package gatewayapi
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	gatewayapiv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gatewayclientset "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// Condition types and reasons set on the CRs this package reconciles,
+// per the Gateway API spec.
+const (
+	conditionAccepted     = "Accepted"
+	conditionResolvedRefs = "ResolvedRefs"
+
+	reasonAccepted       = "Accepted"
+	reasonResolvedRefs   = "ResolvedRefs"
+	reasonInvalidBackend = "BackendNotFound"
+)
+
+// Config describes how to reach the cluster and which Gateway to source
+// routes from.
+type Config struct {
+	// Kubeconfig is a path to a kubeconfig file. Left empty, InCluster
+	// must be true.
+	Kubeconfig string
+	InCluster  bool
+
+	// GatewayNamespace/GatewayName select the single Gateway whose
+	// listeners this Store materializes into Addrs/TLSAddrs. Routes are
+	// drawn from every HTTPRoute/TLSRoute/TCPRoute that lists it as a
+	// parent, regardless of namespace.
+	GatewayNamespace string
+	GatewayName      string
+}
+
+// Store is a router.DataStore that watches the Gateway API resources
+// named by Config and translates them into router.Route objects.
+type Store struct {
+	cfg Config
+
+	kube    kubernetes.Interface
+	gateway gatewayclientset.Interface
+
+	mu     sync.Mutex
+	routes map[string]*router.Route
+}
+
+// NewStore builds a Store connected per cfg, using an in-cluster config
+// when cfg.InCluster is set and cfg.Kubeconfig otherwise.
+func NewStore(cfg Config) (*Store, error) {
+	restCfg, err := restConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: building client config: %s", err)
+	}
+	kube, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: building kube client: %s", err)
+	}
+	gw, err := gatewayclientset.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: building gateway-api client: %s", err)
+	}
+	return &Store{cfg: cfg, kube: kube, gateway: gw, routes: make(map[string]*router.Route)}, nil
+}
+
+func restConfig(cfg Config) (*rest.Config, error) {
+	if cfg.InCluster {
+		return rest.InClusterConfig()
+	}
+	return clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+}
+
+// List returns the routes currently materialized from the cluster's
+// Gateway API resources.
+func (s *Store) List() ([]*router.Route, error) {
+	gw, err := s.gateway.GatewayV1().Gateways(s.cfg.GatewayNamespace).Get(context.Background(), s.cfg.GatewayName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: getting gateway %s/%s: %s", s.cfg.GatewayNamespace, s.cfg.GatewayName, err)
+	}
+
+	httpRoutes, err := s.gateway.GatewayV1().HTTPRoutes("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: listing httproutes: %s", err)
+	}
+	tlsRoutes, err := s.gateway.GatewayV1alpha2().TLSRoutes("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: listing tlsroutes: %s", err)
+	}
+	tcpRoutes, err := s.gateway.GatewayV1alpha2().TCPRoutes("").List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: listing tcproutes: %s", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = make(map[string]*router.Route)
+	for i := range httpRoutes.Items {
+		hr := &httpRoutes.Items[i]
+		if !parents(hr.Spec.ParentRefs).has(gw) {
+			continue
+		}
+		routes, err := s.translateHTTPRoute(gw, hr)
+		if err != nil {
+			s.setHTTPRouteStatus(hr, false, reasonInvalidBackend, err.Error())
+			continue
+		}
+		s.setHTTPRouteStatus(hr, true, reasonAccepted, "")
+		for _, route := range routes {
+			s.routes[route.ID] = route
+		}
+	}
+	for i := range tlsRoutes.Items {
+		tr := &tlsRoutes.Items[i]
+		if !parents(tr.Spec.ParentRefs).has(gw) {
+			continue
+		}
+		routes, err := s.translateTLSRoute(gw, tr)
+		if err != nil {
+			s.setTLSRouteStatus(tr, false, reasonInvalidBackend, err.Error())
+			continue
+		}
+		s.setTLSRouteStatus(tr, true, reasonAccepted, "")
+		for _, route := range routes {
+			s.routes[route.ID] = route
+		}
+	}
+	for i := range tcpRoutes.Items {
+		tr := &tcpRoutes.Items[i]
+		if !parents(tr.Spec.ParentRefs).has(gw) {
+			continue
+		}
+		routes, err := s.translateTCPRoute(gw, tr)
+		if err != nil {
+			s.setTCPRouteStatus(tr, false, reasonInvalidBackend, err.Error())
+			continue
+		}
+		s.setTCPRouteStatus(tr, true, reasonAccepted, "")
+		for _, route := range routes {
+			s.routes[route.ID] = route
+		}
+	}
+
+	out := make([]*router.Route, 0, len(s.routes))
+	for _, route := range s.routes {
+		out = append(out, route)
+	}
+	return out, nil
+}
+
+// StreamEvents watches HTTPRoutes, TLSRoutes and TCPRoutes (and,
+// transitively, the Gateway they reference) and sends a "set" or
+// "remove" event to events for every change, re-translating the
+// affected route each time. The returned Stream closes, as router.Syncer
+// expects, when any of the three underlying watches ends, so the caller
+// can call List and StreamEvents again to resync all of them together.
+func (s *Store) StreamEvents(events chan *router.Event) (*watchStream, error) {
+	httpWatcher, err := s.gateway.GatewayV1().HTTPRoutes("").Watch(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: watching httproutes: %s", err)
+	}
+	tlsWatcher, err := s.gateway.GatewayV1alpha2().TLSRoutes("").Watch(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		httpWatcher.Stop()
+		return nil, fmt.Errorf("gatewayapi: watching tlsroutes: %s", err)
+	}
+	tcpWatcher, err := s.gateway.GatewayV1alpha2().TCPRoutes("").Watch(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		httpWatcher.Stop()
+		tlsWatcher.Stop()
+		return nil, fmt.Errorf("gatewayapi: watching tcproutes: %s", err)
+	}
+
+	stream := &watchStream{done: make(chan struct{})}
+	stopAll := func() {
+		httpWatcher.Stop()
+		tlsWatcher.Stop()
+		tcpWatcher.Stop()
+	}
+
+	var wg sync.WaitGroup
+	var errMu sync.Mutex
+	setErr := func(err error) {
+		errMu.Lock()
+		defer errMu.Unlock()
+		if stream.err == nil {
+			stream.err = err
+		}
+	}
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer stopAll()
+		for event := range httpWatcher.ResultChan() {
+			hr, ok := event.Object.(*gatewayapiv1.HTTPRoute)
+			if !ok {
+				continue
+			}
+			if err := s.handleHTTPRouteEvent(hr, event.Type, events); err != nil {
+				setErr(err)
+				stopAll()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer stopAll()
+		for event := range tlsWatcher.ResultChan() {
+			tr, ok := event.Object.(*gatewayapiv1alpha2.TLSRoute)
+			if !ok {
+				continue
+			}
+			if err := s.handleTLSRouteEvent(tr, event.Type, events); err != nil {
+				setErr(err)
+				stopAll()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer stopAll()
+		for event := range tcpWatcher.ResultChan() {
+			tr, ok := event.Object.(*gatewayapiv1alpha2.TCPRoute)
+			if !ok {
+				continue
+			}
+			if err := s.handleTCPRouteEvent(tr, event.Type, events); err != nil {
+				setErr(err)
+				stopAll()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(events)
+		close(stream.done)
+	}()
+	return stream, nil
+}
+
+// removeRoutesForParent deletes every route keyed to parentRef from
+// s.routes, sending a "remove" event for each, the shared first step
+// handleHTTPRouteEvent/handleTLSRouteEvent/handleTCPRouteEvent all take
+// before re-translating (or, for a deletion, not re-translating) the
+// parent resource that changed.
+func (s *Store) removeRoutesForParent(parentRef string, events chan *router.Event) {
+	s.mu.Lock()
+	var prevIDs []string
+	for id, route := range s.routes {
+		if route.ParentRef == parentRef {
+			prevIDs = append(prevIDs, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, id := range prevIDs {
+		s.mu.Lock()
+		delete(s.routes, id)
+		s.mu.Unlock()
+		events <- &router.Event{Event: "remove", ID: id}
+	}
+}
+
+func (s *Store) getGateway() (*gatewayapiv1.Gateway, error) {
+	gw, err := s.gateway.GatewayV1().Gateways(s.cfg.GatewayNamespace).Get(context.Background(), s.cfg.GatewayName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return gw, err
+}
+
+func (s *Store) handleHTTPRouteEvent(hr *gatewayapiv1.HTTPRoute, eventType watch.EventType, events chan *router.Event) error {
+	s.removeRoutesForParent(httpRouteKey(hr), events)
+	if eventType == watch.Deleted {
+		return nil
+	}
+
+	gw, err := s.getGateway()
+	if err != nil || gw == nil || !parents(hr.Spec.ParentRefs).has(gw) {
+		return err
+	}
+
+	routes, err := s.translateHTTPRoute(gw, hr)
+	if err != nil {
+		s.setHTTPRouteStatus(hr, false, reasonInvalidBackend, err.Error())
+		return nil
+	}
+	s.setHTTPRouteStatus(hr, true, reasonAccepted, "")
+
+	s.mu.Lock()
+	for _, route := range routes {
+		s.routes[route.ID] = route
+	}
+	s.mu.Unlock()
+	for _, route := range routes {
+		events <- &router.Event{Event: "set", Route: route}
+	}
+	return nil
+}
+
+func (s *Store) handleTLSRouteEvent(tr *gatewayapiv1alpha2.TLSRoute, eventType watch.EventType, events chan *router.Event) error {
+	s.removeRoutesForParent(tlsRouteKey(tr), events)
+	if eventType == watch.Deleted {
+		return nil
+	}
+
+	gw, err := s.getGateway()
+	if err != nil || gw == nil || !parents(tr.Spec.ParentRefs).has(gw) {
+		return err
+	}
+
+	routes, err := s.translateTLSRoute(gw, tr)
+	if err != nil {
+		s.setTLSRouteStatus(tr, false, reasonInvalidBackend, err.Error())
+		return nil
+	}
+	s.setTLSRouteStatus(tr, true, reasonAccepted, "")
+
+	s.mu.Lock()
+	for _, route := range routes {
+		s.routes[route.ID] = route
+	}
+	s.mu.Unlock()
+	for _, route := range routes {
+		events <- &router.Event{Event: "set", Route: route}
+	}
+	return nil
+}
+
+func (s *Store) handleTCPRouteEvent(tr *gatewayapiv1alpha2.TCPRoute, eventType watch.EventType, events chan *router.Event) error {
+	s.removeRoutesForParent(tcpRouteKey(tr), events)
+	if eventType == watch.Deleted {
+		return nil
+	}
+
+	gw, err := s.getGateway()
+	if err != nil || gw == nil || !parents(tr.Spec.ParentRefs).has(gw) {
+		return err
+	}
+
+	routes, err := s.translateTCPRoute(gw, tr)
+	if err != nil {
+		s.setTCPRouteStatus(tr, false, reasonInvalidBackend, err.Error())
+		return nil
+	}
+	s.setTCPRouteStatus(tr, true, reasonAccepted, "")
+
+	s.mu.Lock()
+	for _, route := range routes {
+		s.routes[route.ID] = route
+	}
+	s.mu.Unlock()
+	for _, route := range routes {
+		events <- &router.Event{Event: "set", Route: route}
+	}
+	return nil
+}
+
+// translateHTTPRoute converts one HTTPRoute's hostnames, rules and
+// backendRefs into router.Route objects, one per (hostname, rule,
+// backendRef, match) combination so that weighted backendRefs become distinct
+// services the discoverd load balancer can be pointed at individually;
+// splitting weighted traffic between them is left to the caller that
+// registers instances under those service names in the ratio the
+// weights describe.
+func (s *Store) translateHTTPRoute(gw *gatewayapiv1.Gateway, hr *gatewayapiv1.HTTPRoute) ([]*router.Route, error) {
+	hostnames := hr.Spec.Hostnames
+	if len(hostnames) == 0 {
+		hostnames = []gatewayapiv1.Hostname{"*"}
+	}
+
+	var routes []*router.Route
+	for _, hostname := range hostnames {
+		domain := string(hostname)
+		for ruleIdx, rule := range hr.Spec.Rules {
+			if len(rule.BackendRefs) == 0 {
+				return nil, fmt.Errorf("rule %d has no backendRefs", ruleIdx)
+			}
+			for refIdx, ref := range rule.BackendRefs {
+				service, err := backendService(hr.Namespace, ref.BackendRef)
+				if err != nil {
+					return nil, err
+				}
+				for matchIdx, match := range oneOrDefault(rule.Matches) {
+					id := fmt.Sprintf("gw:%s:%d:%d:%d:%s", httpRouteKey(hr), ruleIdx, refIdx, matchIdx, domain)
+					route := router.HTTPRoute{
+						ID:        id,
+						ParentRef: httpRouteKey(hr),
+						Domain:    domain,
+						Service:   service,
+						Match:     translateMatch(match),
+					}.ToRoute()
+					routes = append(routes, route)
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+// translateTLSRoute converts one TLSRoute's rules and backendRefs into
+// router.Route objects, one per (rule, backendRef) combination, the same
+// granularity translateHTTPRoute uses for weighted backendRefs. The
+// route's Port is that of the Gateway listener it attaches to.
+//
+// TLSRoute's Hostnames (matched against the TLS ClientHello's SNI) have
+// no counterpart on router.Route: the router's TCP listener forwards a
+// whole port to one backend pool with no per-connection inspection, so
+// unlike an HTTPRoute's per-hostname routes, every hostname here
+// collapses onto the same routes. A Gateway wanting SNI-based routing to
+// distinct backend pools needs one TLS listener (and port) per hostname.
+func (s *Store) translateTLSRoute(gw *gatewayapiv1.Gateway, tr *gatewayapiv1alpha2.TLSRoute) ([]*router.Route, error) {
+	port, ok := listenerPort(gw, tr.Spec.ParentRefs, gatewayapiv1.TLSProtocolType)
+	if !ok {
+		return nil, fmt.Errorf("no TLS listener on gateway %s/%s matches this route's parentRefs", gw.Namespace, gw.Name)
+	}
+
+	var routes []*router.Route
+	for ruleIdx, rule := range tr.Spec.Rules {
+		if len(rule.BackendRefs) == 0 {
+			return nil, fmt.Errorf("rule %d has no backendRefs", ruleIdx)
+		}
+		for refIdx, ref := range rule.BackendRefs {
+			service, err := backendService(tr.Namespace, ref)
+			if err != nil {
+				return nil, err
+			}
+			id := fmt.Sprintf("gw:%s:%d:%d", tlsRouteKey(tr), ruleIdx, refIdx)
+			routes = append(routes, router.TCPRoute{
+				ID:        id,
+				ParentRef: tlsRouteKey(tr),
+				Service:   service,
+				Port:      port,
+			}.ToRoute())
+		}
+	}
+	return routes, nil
+}
+
+// translateTCPRoute converts one TCPRoute's rules and backendRefs into
+// router.Route objects, one per (rule, backendRef) combination, the same
+// granularity translateHTTPRoute uses for weighted backendRefs. The
+// route's Port is that of the Gateway listener it attaches to.
+func (s *Store) translateTCPRoute(gw *gatewayapiv1.Gateway, tr *gatewayapiv1alpha2.TCPRoute) ([]*router.Route, error) {
+	port, ok := listenerPort(gw, tr.Spec.ParentRefs, gatewayapiv1.TCPProtocolType)
+	if !ok {
+		return nil, fmt.Errorf("no TCP listener on gateway %s/%s matches this route's parentRefs", gw.Namespace, gw.Name)
+	}
+
+	var routes []*router.Route
+	for ruleIdx, rule := range tr.Spec.Rules {
+		if len(rule.BackendRefs) == 0 {
+			return nil, fmt.Errorf("rule %d has no backendRefs", ruleIdx)
+		}
+		for refIdx, ref := range rule.BackendRefs {
+			service, err := backendService(tr.Namespace, ref)
+			if err != nil {
+				return nil, err
+			}
+			id := fmt.Sprintf("gw:%s:%d:%d", tcpRouteKey(tr), ruleIdx, refIdx)
+			routes = append(routes, router.TCPRoute{
+				ID:        id,
+				ParentRef: tcpRouteKey(tr),
+				Service:   service,
+				Port:      port,
+			}.ToRoute())
+		}
+	}
+	return routes, nil
+}
+
+// listenerPort finds the port of gw's listener with the given protocol
+// (TCPProtocolType or TLSProtocolType) that a TLSRoute/TCPRoute's
+// parentRefs attaches to, honoring a ref's SectionName/Port if either
+// was specified to disambiguate between several same-protocol listeners.
+func listenerPort(gw *gatewayapiv1.Gateway, refs []gatewayapiv1.ParentReference, protocol gatewayapiv1.ProtocolType) (int32, bool) {
+	for _, ref := range refs {
+		if !(parentRefs{ref}).has(gw) {
+			continue
+		}
+		for _, l := range gw.Spec.Listeners {
+			if l.Protocol != protocol {
+				continue
+			}
+			if ref.SectionName != nil && string(*ref.SectionName) != string(l.Name) {
+				continue
+			}
+			if ref.Port != nil && int32(*ref.Port) != int32(l.Port) {
+				continue
+			}
+			return int32(l.Port), true
+		}
+	}
+	return 0, false
+}
+
+// backendService maps a backendRef to the discoverd service name routed
+// requests should be load balanced across; weight isn't carried onto
+// router.Route since the router's load balancing operates on discoverd
+// instances rather than route weights, so a weighted split is achieved
+// by registering instances proportionally under each backendRef's
+// service rather than here.
+func backendService(defaultNamespace string, ref gatewayapiv1.BackendRef) (string, error) {
+	if ref.Kind != nil && *ref.Kind != "Service" {
+		return "", fmt.Errorf("unsupported backendRef kind %q", *ref.Kind)
+	}
+	namespace := defaultNamespace
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	return namespace + "/" + string(ref.Name), nil
+}
+
+// oneOrDefault returns matches, or a single wildcard match if the rule
+// specified none (a rule with no Matches applies to all requests).
+func oneOrDefault(matches []gatewayapiv1.HTTPRouteMatch) []gatewayapiv1.HTTPRouteMatch {
+	if len(matches) == 0 {
+		return []gatewayapiv1.HTTPRouteMatch{{}}
+	}
+	return matches
+}
+
+// translateMatch converts one Gateway API HTTPRouteMatch into the
+// router's own Match predicate.
+func translateMatch(match gatewayapiv1.HTTPRouteMatch) *router.Match {
+	m := &router.Match{Headers: make(map[string]string), Query: make(map[string]string)}
+
+	if match.Path != nil && match.Path.Value != nil {
+		if match.Path.Type != nil && *match.Path.Type == gatewayapiv1.PathMatchRegularExpression {
+			m.PathRegex = *match.Path.Value
+		} else {
+			m.PathPrefix = *match.Path.Value
+		}
+	}
+	if match.Method != nil {
+		m.Methods = []string{string(*match.Method)}
+	}
+	for _, h := range match.Headers {
+		key := string(h.Name)
+		if h.Type != nil && *h.Type == gatewayapiv1.HeaderMatchRegularExpression {
+			m.Headers[key] = "regex:" + h.Value
+		} else {
+			m.Headers[key] = h.Value
+		}
+	}
+	for _, q := range match.QueryParams {
+		key := string(q.Name)
+		if q.Type != nil && *q.Type == gatewayapiv1.QueryParamMatchRegularExpression {
+			m.Query[key] = "regex:" + q.Value
+		} else {
+			m.Query[key] = q.Value
+		}
+	}
+	if len(m.Headers) == 0 {
+		m.Headers = nil
+	}
+	if len(m.Query) == 0 {
+		m.Query = nil
+	}
+	return m
+}
+
+// ListenerAddrs returns the host:port pairs a Gateway's plain-HTTP and
+// TLS listeners should bind to, and the certificates (pulled from each
+// TLS listener's referenced Secret) the HTTPListener should serve by
+// default for domains without their own route certificate.
+func (s *Store) ListenerAddrs(gw *gatewayapiv1.Gateway) (addrs, tlsAddrs []string, certs []*router.Certificate, err error) {
+	for _, l := range gw.Spec.Listeners {
+		addr := "0.0.0.0:" + strconv.Itoa(int(l.Port))
+		switch l.Protocol {
+		case gatewayapiv1.HTTPProtocolType:
+			addrs = append(addrs, addr)
+		case gatewayapiv1.HTTPSProtocolType:
+			tlsAddrs = append(tlsAddrs, addr)
+			if l.TLS == nil {
+				continue
+			}
+			for _, ref := range l.TLS.CertificateRefs {
+				cert, err := s.secretCertificate(gw.Namespace, ref)
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return addrs, tlsAddrs, certs, nil
+}
+
+func (s *Store) secretCertificate(defaultNamespace string, ref gatewayapiv1.SecretObjectReference) (*router.Certificate, error) {
+	namespace := defaultNamespace
+	if ref.Namespace != nil {
+		namespace = string(*ref.Namespace)
+	}
+	secret, err := s.kube.CoreV1().Secrets(namespace).Get(context.Background(), string(ref.Name), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("gatewayapi: getting secret %s/%s: %s", namespace, ref.Name, err)
+	}
+	return &router.Certificate{
+		Cert: string(secret.Data[corev1.TLSCertKey]),
+		Key:  string(secret.Data[corev1.TLSPrivateKeyKey]),
+	}, nil
+}
+
+// acceptedConditions builds the Accepted and ResolvedRefs conditions
+// shared by setHTTPRouteStatus/setTLSRouteStatus/setTCPRouteStatus.
+func acceptedConditions(ok bool, reason, message string, generation int64) (cond, resolved metav1.Condition) {
+	status := metav1.ConditionTrue
+	if !ok {
+		status = metav1.ConditionFalse
+	}
+	now := metav1.Now()
+	cond = metav1.Condition{
+		Type:               conditionAccepted,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: now,
+		ObservedGeneration: generation,
+	}
+	resolved = cond
+	resolved.Type = conditionResolvedRefs
+	if ok {
+		resolved.Reason = reasonResolvedRefs
+	}
+	return cond, resolved
+}
+
+// applyConditions writes cond and resolved onto every parent status, the
+// shared second step of setHTTPRouteStatus/setTLSRouteStatus/
+// setTCPRouteStatus.
+func applyConditions(parents []gatewayapiv1.RouteParentStatus, cond, resolved metav1.Condition) {
+	for i := range parents {
+		parents[i].Conditions = replaceCondition(parents[i].Conditions, cond)
+		parents[i].Conditions = replaceCondition(parents[i].Conditions, resolved)
+	}
+}
+
+// setHTTPRouteStatus reconciles the Accepted and ResolvedRefs conditions
+// onto hr, best-effort: a failure to update status doesn't fail the
+// sync, since the router's own behavior (whether the route was actually
+// applied) doesn't depend on it.
+func (s *Store) setHTTPRouteStatus(hr *gatewayapiv1.HTTPRoute, ok bool, reason, message string) {
+	cond, resolved := acceptedConditions(ok, reason, message, hr.Generation)
+	applyConditions(hr.Status.Parents, cond, resolved)
+	s.gateway.GatewayV1().HTTPRoutes(hr.Namespace).UpdateStatus(context.Background(), hr, metav1.UpdateOptions{})
+}
+
+// setTLSRouteStatus is setHTTPRouteStatus's counterpart for TLSRoute.
+func (s *Store) setTLSRouteStatus(tr *gatewayapiv1alpha2.TLSRoute, ok bool, reason, message string) {
+	cond, resolved := acceptedConditions(ok, reason, message, tr.Generation)
+	applyConditions(tr.Status.Parents, cond, resolved)
+	s.gateway.GatewayV1alpha2().TLSRoutes(tr.Namespace).UpdateStatus(context.Background(), tr, metav1.UpdateOptions{})
+}
+
+// setTCPRouteStatus is setHTTPRouteStatus's counterpart for TCPRoute.
+func (s *Store) setTCPRouteStatus(tr *gatewayapiv1alpha2.TCPRoute, ok bool, reason, message string) {
+	cond, resolved := acceptedConditions(ok, reason, message, tr.Generation)
+	applyConditions(tr.Status.Parents, cond, resolved)
+	s.gateway.GatewayV1alpha2().TCPRoutes(tr.Namespace).UpdateStatus(context.Background(), tr, metav1.UpdateOptions{})
+}
+
+func replaceCondition(conditions []metav1.Condition, cond metav1.Condition) []metav1.Condition {
+	for i, c := range conditions {
+		if c.Type == cond.Type {
+			conditions[i] = cond
+			return conditions
+		}
+	}
+	return append(conditions, cond)
+}
+
+func httpRouteKey(hr *gatewayapiv1.HTTPRoute) string {
+	return hr.Namespace + "/" + hr.Name
+}
+
+func tlsRouteKey(tr *gatewayapiv1alpha2.TLSRoute) string {
+	return tr.Namespace + "/" + tr.Name
+}
+
+func tcpRouteKey(tr *gatewayapiv1alpha2.TCPRoute) string {
+	return tr.Namespace + "/" + tr.Name
+}
+
+type parentRefs []gatewayapiv1.ParentReference
+
+func parents(refs []gatewayapiv1.ParentReference) parentRefs { return refs }
+
+func (refs parentRefs) has(gw *gatewayapiv1.Gateway) bool {
+	for _, ref := range refs {
+		namespace := gw.Namespace
+		if ref.Namespace != nil {
+			namespace = string(*ref.Namespace)
+		}
+		if string(ref.Name) == gw.Name && namespace == gw.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// watchStream adapts a Kubernetes watch.Interface to the router.Stream
+// interface expected by Syncer: it closes once the watch loop above
+// exits, carrying the error (if any) that ended it.
+type watchStream struct {
+	done chan struct{}
+	err  error
+}
+
+// Err returns the error that ended the stream, if any, blocking until
+// the stream has actually closed.
+func (w *watchStream) Err() error {
+	<-w.done
+	return w.err
+}
@@ -0,0 +1,217 @@
+package gatewayapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	gatewayapiv1 "sigs.k8s.io/gateway-api/apis/v1"
+	gatewayapiv1alpha2 "sigs.k8s.io/gateway-api/apis/v1alpha2"
+	gatewayfake "sigs.k8s.io/gateway-api/pkg/client/clientset/versioned/fake"
+
+	router "github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+const (
+	testNamespace = "default"
+	testGateway   = "gw"
+)
+
+func testStore(gw *gatewayapiv1.Gateway, objects ...runtime.Object) *Store {
+	gwObjects := append([]runtime.Object{gw}, objects...)
+	return &Store{
+		cfg:     Config{GatewayNamespace: testNamespace, GatewayName: testGateway},
+		kube:    kubefake.NewSimpleClientset(),
+		gateway: gatewayfake.NewSimpleClientset(gwObjects...),
+		routes:  make(map[string]*router.Route),
+	}
+}
+
+func testGatewayObject() *gatewayapiv1.Gateway {
+	return &gatewayapiv1.Gateway{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: testGateway},
+		Spec: gatewayapiv1.GatewaySpec{
+			Listeners: []gatewayapiv1.Listener{
+				{Name: "http", Port: 8080, Protocol: gatewayapiv1.HTTPProtocolType},
+				{Name: "tls", Port: 8443, Protocol: gatewayapiv1.TLSProtocolType},
+				{Name: "tcp", Port: 9000, Protocol: gatewayapiv1.TCPProtocolType},
+			},
+		},
+	}
+}
+
+func testParentRef() gatewayapiv1.ParentReference {
+	name := gatewayapiv1.ObjectName(testGateway)
+	return gatewayapiv1.ParentReference{Name: name}
+}
+
+func testBackendRef(service string) gatewayapiv1.BackendRef {
+	name := gatewayapiv1.ObjectName(service)
+	return gatewayapiv1.BackendRef{BackendObjectReference: gatewayapiv1.BackendObjectReference{Name: name}}
+}
+
+func testHTTPRoute(name, domain, service string) *gatewayapiv1.HTTPRoute {
+	return &gatewayapiv1.HTTPRoute{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: gatewayapiv1.HTTPRouteSpec{
+			CommonRouteSpec: gatewayapiv1.CommonRouteSpec{ParentRefs: []gatewayapiv1.ParentReference{testParentRef()}},
+			Hostnames:       []gatewayapiv1.Hostname{gatewayapiv1.Hostname(domain)},
+			Rules: []gatewayapiv1.HTTPRouteRule{{
+				BackendRefs: []gatewayapiv1.HTTPBackendRef{{BackendRef: testBackendRef(service)}},
+			}},
+		},
+	}
+}
+
+func testTLSRoute(name, service string) *gatewayapiv1alpha2.TLSRoute {
+	return &gatewayapiv1alpha2.TLSRoute{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: gatewayapiv1alpha2.TLSRouteSpec{
+			CommonRouteSpec: gatewayapiv1alpha2.CommonRouteSpec{ParentRefs: []gatewayapiv1alpha2.ParentReference{testParentRef()}},
+			Rules: []gatewayapiv1alpha2.TLSRouteRule{{
+				BackendRefs: []gatewayapiv1alpha2.BackendRef{testBackendRef(service)},
+			}},
+		},
+	}
+}
+
+func testTCPRoute(name, service string) *gatewayapiv1alpha2.TCPRoute {
+	return &gatewayapiv1alpha2.TCPRoute{
+		ObjectMeta: metav1.ObjectMeta{Namespace: testNamespace, Name: name},
+		Spec: gatewayapiv1alpha2.TCPRouteSpec{
+			CommonRouteSpec: gatewayapiv1alpha2.CommonRouteSpec{ParentRefs: []gatewayapiv1alpha2.ParentReference{testParentRef()}},
+			Rules: []gatewayapiv1alpha2.TCPRouteRule{{
+				BackendRefs: []gatewayapiv1alpha2.BackendRef{testBackendRef(service)},
+			}},
+		},
+	}
+}
+
+func routeByType(routes []*router.Route, typ string) *router.Route {
+	for _, r := range routes {
+		if r.Type == typ {
+			return r
+		}
+	}
+	return nil
+}
+
+func (s *S) TestListTranslatesAllRouteKinds(c *C) {
+	gw := testGatewayObject()
+	hr := testHTTPRoute("hr", "example.com", "http-backend")
+	tr := testTLSRoute("tr", "tls-backend")
+	tcr := testTCPRoute("tcr", "tcp-backend")
+	store := testStore(gw, hr, tr, tcr)
+
+	routes, err := store.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 3)
+
+	http := routeByType(routes, router.RouteTypeHTTP)
+	c.Assert(http, NotNil)
+	c.Assert(http.Domain, Equals, "example.com")
+	c.Assert(http.Service, Equals, testNamespace+"/http-backend")
+
+	var tls, tcp *router.Route
+	for _, r := range routes {
+		if r.Type == router.RouteTypeTCP {
+			if r.Port == 8443 {
+				tls = r
+			} else if r.Port == 9000 {
+				tcp = r
+			}
+		}
+	}
+	c.Assert(tls, NotNil)
+	c.Assert(tls.Service, Equals, testNamespace+"/tls-backend")
+	c.Assert(tcp, NotNil)
+	c.Assert(tcp.Service, Equals, testNamespace+"/tcp-backend")
+}
+
+// TestListResyncConvergesState exercises the same "converge to the
+// cluster's current state" guarantee TestHTTPResync verifies for the
+// controller-backed store: since this Store has no persistent
+// connection of its own to drop and reconnect, the analogous scenario
+// is Syncer calling List again after StreamEvents' watches end, which
+// must reflect whatever changed on the cluster in between rather than
+// anything cached from the first List.
+func (s *S) TestListResyncConvergesState(c *C) {
+	gw := testGatewayObject()
+	hr := testHTTPRoute("hr", "example.com", "v1")
+	tr := testTLSRoute("tr", "tls-v1")
+	store := testStore(gw, hr, tr)
+
+	routes, err := store.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+
+	ctx := context.Background()
+	c.Assert(store.gateway.GatewayV1().HTTPRoutes(testNamespace).Delete(ctx, "hr", metav1.DeleteOptions{}), IsNil)
+	c.Assert(store.gateway.GatewayV1alpha2().TLSRoutes(testNamespace).Delete(ctx, "tr", metav1.DeleteOptions{}), IsNil)
+	_, err = store.gateway.GatewayV1().HTTPRoutes(testNamespace).Create(ctx, testHTTPRoute("hr2", "example.org", "v2"), metav1.CreateOptions{})
+	c.Assert(err, IsNil)
+	_, err = store.gateway.GatewayV1alpha2().TCPRoutes(testNamespace).Create(ctx, testTCPRoute("tcr2", "tcp-v2"), metav1.CreateOptions{})
+	c.Assert(err, IsNil)
+
+	routes, err = store.List()
+	c.Assert(err, IsNil)
+	c.Assert(routes, HasLen, 2)
+
+	http := routeByType(routes, router.RouteTypeHTTP)
+	c.Assert(http, NotNil)
+	c.Assert(http.Domain, Equals, "example.org")
+	c.Assert(http.Service, Equals, testNamespace+"/v2")
+
+	tcp := routeByType(routes, router.RouteTypeTCP)
+	c.Assert(tcp, NotNil)
+	c.Assert(tcp.Port, Equals, int32(9000))
+	c.Assert(tcp.Service, Equals, testNamespace+"/tcp-v2")
+}
+
+func (s *S) TestStreamEventsDeliversSetAndRemove(c *C) {
+	gw := testGatewayObject()
+	store := testStore(gw)
+
+	events := make(chan *router.Event, 16)
+	stream, err := store.StreamEvents(events)
+	c.Assert(err, IsNil)
+	c.Assert(stream, NotNil)
+
+	ctx := context.Background()
+	_, err = store.gateway.GatewayV1().HTTPRoutes(testNamespace).Create(ctx, testHTTPRoute("hr", "example.com", "v1"), metav1.CreateOptions{})
+	c.Assert(err, IsNil)
+
+	e := waitForRouteEvent(c, events, "set")
+	c.Assert(e.Route.Type, Equals, router.RouteTypeHTTP)
+	c.Assert(e.Route.Domain, Equals, "example.com")
+
+	err = store.gateway.GatewayV1().HTTPRoutes(testNamespace).Delete(ctx, "hr", metav1.DeleteOptions{})
+	c.Assert(err, IsNil)
+
+	e = waitForRouteEvent(c, events, "remove")
+	c.Assert(e.ID, Equals, "gw:"+testNamespace+"/hr:0:0:0:example.com")
+}
+
+func waitForRouteEvent(c *C, events chan *router.Event, kind string) *router.Event {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Event == kind {
+				return e
+			}
+		case <-timeout:
+			c.Fatalf("timed out waiting for %q event", kind)
+		}
+	}
+}
@@ -0,0 +1,892 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/metrics"
+	"github.com/flynn/flynn/router/proxy"
+	router "github.com/flynn/flynn/router/types"
+	log15 "github.com/inconshreveable/log15"
+	"golang.org/x/net/http2"
+)
+
+var (
+	requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9/_+=-]{20,200}$`)
+	logger           = log15.New("component", "router")
+)
+
+// HTTPListener accepts HTTP and HTTPS connections, routes them to
+// backends according to the set of router.Route objects it syncs from
+// a Syncer, and reverse proxies the request using router/proxy.
+type HTTPListener struct {
+	Addrs    []string
+	TLSAddrs []string
+
+	// keypair is used for TLS connections to domains that don't have
+	// their own certificate configured.
+	keypair tls.Certificate
+
+	syncer    *Syncer
+	discoverd discoverdClient
+
+	proxyProtocol bool
+
+	// Metrics, if set, receives per-route request/latency/in-flight
+	// metrics. MetricsAddr, if non-empty, serves Metrics on its own
+	// internal listener.
+	Metrics     *metrics.Registry
+	MetricsAddr string
+
+	// TrustedProxies lists the CIDRs a connection's immediate peer must
+	// fall within for its X-Forwarded-*/Forwarded headers to be
+	// trusted. A peer outside every CIDR here (and whose route doesn't
+	// set TrustForwardHeader) has its forwarded headers overwritten
+	// from scratch rather than appended to, since otherwise it could
+	// forge a chain that makes an attacker's request look like it came
+	// through a trusted hop.
+	TrustedProxies []net.IPNet
+
+	// EmitForwardedHeader additionally sets the standard RFC 7239
+	// Forwarded header alongside the X-Forwarded-* headers.
+	EmitForwardedHeader bool
+
+	// AccessLog, if set, receives one Record per request (or, for an
+	// Upgrade request, per tunnelled session) served through this
+	// listener.
+	AccessLog *proxy.AccessLog
+
+	// StickyCookieSecrets signs sticky session cookies so their value
+	// names a backend opaquely instead of exposing its raw address/job
+	// ID, and so a forged or stale value is rejected rather than pinning
+	// a request to an arbitrary host. The first secret signs new
+	// cookies; every secret is accepted when verifying one, so a secret
+	// can be rotated by prepending a new one and only removing the
+	// oldest once no outstanding cookie can still depend on it. Left
+	// empty, sticky cookies carry the backend identifier in the clear,
+	// as before.
+	StickyCookieSecrets [][]byte
+
+	defaultPorts []int
+
+	// preSync/postSync are test hooks; preSync is invoked before each
+	// (re)connection attempt to the DataStore, postSync is invoked with
+	// a channel that's closed once that attempt's initial listing has
+	// been fully applied.
+	preSync  func()
+	postSync func(startc <-chan struct{})
+
+	listeners []net.Listener
+
+	mu     sync.RWMutex
+	routes map[string]*httpRoute
+	table  domainTable
+
+	watchersMu sync.Mutex
+	watchers   map[chan *router.Event]struct{}
+
+	closeOnce sync.Once
+	closeCh   chan struct{}
+}
+
+type httpRoute struct {
+	route *router.Route
+	proxy *proxy.Proxy
+	match *compiledMatch
+}
+
+// discoverdClient is the subset of *discoverd.Client's wire API the
+// HTTP listener depends on, narrowed out so tests can swap in
+// testutils.FakeDiscoverd instead of a real etcd-backed discoverd.
+type discoverdClient interface {
+	AddService(service string, config *discoverd.ServiceConfig) error
+	RegisterInstance(service string, inst *discoverd.Instance) (discoverd.Heartbeater, error)
+	Service(service string) discoverd.Service
+	Instances(service string, timeout time.Duration) ([]*discoverd.Instance, error)
+}
+
+// NewHTTPListener returns an HTTPListener that syncs routes of type
+// "http" from store and looks up backends via sd.
+func NewHTTPListener(store DataStore, sd discoverdClient, addrs, tlsAddrs []string, keypair tls.Certificate) *HTTPListener {
+	return &HTTPListener{
+		Addrs:     addrs,
+		TLSAddrs:  tlsAddrs,
+		keypair:   keypair,
+		syncer:    NewSyncer(store, router.RouteTypeHTTP),
+		discoverd: sd,
+	}
+}
+
+// Start binds the configured addresses and begins syncing routes and
+// serving traffic. It returns once the listeners are bound; serving
+// happens in background goroutines.
+func (l *HTTPListener) Start() error {
+	l.routes = make(map[string]*httpRoute)
+	l.watchers = make(map[chan *router.Event]struct{})
+	l.closeCh = make(chan struct{})
+
+	for i, addr := range l.Addrs {
+		nl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		l.Addrs[i] = nl.Addr().String()
+		l.listeners = append(l.listeners, nl)
+		go l.serve(nl, false)
+	}
+
+	for i, addr := range l.TLSAddrs {
+		nl, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		l.TLSAddrs[i] = nl.Addr().String()
+		l.listeners = append(l.listeners, nl)
+		go l.serve(nl, true)
+	}
+
+	if l.MetricsAddr != "" && l.Metrics != nil {
+		nl, err := net.Listen("tcp", l.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		l.MetricsAddr = nl.Addr().String()
+		l.listeners = append(l.listeners, nl)
+		go (&http.Server{Handler: l.Metrics.Handler()}).Serve(nl)
+	}
+
+	go l.run()
+
+	return nil
+}
+
+// Close stops accepting new connections and tears down the sync loop.
+func (l *HTTPListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	for _, nl := range l.listeners {
+		nl.Close()
+	}
+	return nil
+}
+
+func (l *HTTPListener) run() {
+	for {
+		if l.preSync != nil {
+			l.preSync()
+		}
+		select {
+		case <-l.closeCh:
+			return
+		default:
+		}
+
+		startc := make(chan struct{})
+		if l.postSync != nil {
+			go l.postSync(startc)
+		}
+		h := &httpSyncHandler{l: l, startc: startc}
+		l.syncer.Sync(h)
+		h.markCurrent()
+
+		select {
+		case <-l.closeCh:
+			return
+		default:
+		}
+	}
+}
+
+type httpSyncHandler struct {
+	l      *HTTPListener
+	startc chan struct{}
+	once   sync.Once
+}
+
+func (h *httpSyncHandler) Set(route *router.Route) error {
+	h.l.setRoute(route)
+	return nil
+}
+
+func (h *httpSyncHandler) Remove(id string) error {
+	h.l.removeRoute(id)
+	return nil
+}
+
+func (h *httpSyncHandler) Current() {
+	h.markCurrent()
+}
+
+func (h *httpSyncHandler) markCurrent() {
+	h.once.Do(func() { close(h.startc) })
+}
+
+func (l *HTTPListener) setRoute(route *router.Route) {
+	match, err := compileMatch(route.Match, route.Path)
+	if err != nil {
+		logger.Error("invalid route match, ignoring it", "route", route.ID, "err", err)
+	}
+	hr := &httpRoute{
+		route: route,
+		match: match,
+		proxy: &proxy.Proxy{
+			Route:                 route.ID,
+			Domain:                route.Domain,
+			Service:               route.Service,
+			Metrics:               l.Metrics,
+			Stickiness:            proxy.NewStickinessMode(route, l.StickyCookieSecrets),
+			Selector:              proxy.NewBackendSelector(route.BackendSelector, route.Service),
+			DisableKeepAlives:     route.DisableKeepAlives,
+			Backends:              l.backendsFunc(route),
+			RateLimiter:           proxy.NewRateLimiter(route.RateLimits),
+			BackendTLS:            route.BackendTLS,
+			BackendProtocol:       route.BackendProtocol,
+			ConnectTimeout:        route.ConnectTimeout,
+			ResponseHeaderTimeout: route.ResponseHeaderTimeout,
+			IdleTimeout:           route.IdleTimeout,
+			CircuitBreaker:        route.CircuitBreaker,
+		},
+	}
+
+	l.mu.Lock()
+	l.routes[route.ID] = hr
+	l.table.set(route, hr)
+	l.mu.Unlock()
+
+	l.notify(&router.Event{Event: "set", ID: route.ID, Route: route})
+}
+
+func (l *HTTPListener) removeRoute(id string) {
+	l.mu.Lock()
+	hr, ok := l.routes[id]
+	if ok {
+		delete(l.routes, id)
+		l.table.remove(hr)
+	}
+	l.mu.Unlock()
+
+	l.notify(&router.Event{Event: "remove", ID: id})
+}
+
+func (l *HTTPListener) notify(event *router.Event) {
+	l.watchersMu.Lock()
+	defer l.watchersMu.Unlock()
+	for ch := range l.watchers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Watch registers ch to receive route events until Unwatch is called.
+func (l *HTTPListener) Watch(ch chan *router.Event) {
+	l.watchersMu.Lock()
+	defer l.watchersMu.Unlock()
+	l.watchers[ch] = struct{}{}
+}
+
+// Unwatch removes a channel previously passed to Watch.
+func (l *HTTPListener) Unwatch(ch chan *router.Event) {
+	l.watchersMu.Lock()
+	defer l.watchersMu.Unlock()
+	delete(l.watchers, ch)
+}
+
+func (l *HTTPListener) backendsFunc(route *router.Route) proxy.BackendListFunc {
+	service := route.Service
+	leader := route.Leader
+	drainTimeout := route.DrainTimeout
+	return func() []*proxy.Backend {
+		if leader {
+			inst, err := l.discoverd.Service(service).Leader()
+			if err != nil || inst == nil {
+				return nil
+			}
+			return []*proxy.Backend{{Addr: inst.Addr, JobID: inst.ID}}
+		}
+		instances, err := l.discoverd.Instances(service, 10*time.Second)
+		if err != nil {
+			return nil
+		}
+		backends := make([]*proxy.Backend, len(instances))
+		for i, inst := range instances {
+			backends[i] = &proxy.Backend{Addr: inst.Addr, JobID: inst.ID}
+		}
+		return proxy.ApplyDraining(service, backends, drainTimeout)
+	}
+}
+
+func (l *HTTPListener) serve(nl net.Listener, useTLS bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", l.serveHTTP(useTLS))
+
+	srv := &http.Server{Handler: mux}
+
+	if useTLS {
+		tlsConfig := &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			NextProtos:     []string{"h2", "http/1.1"},
+			GetCertificate: l.getCertificate,
+		}
+		http2.ConfigureServer(srv, &http2.Server{})
+		nl = &handshakingTLSListener{
+			Listener: tls.NewListener(&proxyProtocolListener{Listener: nl, enabled: l.proxyProtocol}, tlsConfig),
+			metrics:  l.Metrics,
+		}
+	} else {
+		nl = &proxyProtocolListener{Listener: nl, enabled: l.proxyProtocol}
+	}
+
+	srv.Serve(nl)
+}
+
+// handshakingTLSListener completes the TLS handshake at Accept time
+// (rather than leaving it to the first Read, as tls.Listener does by
+// default) so that handshake failures can be counted without being
+// misattributed to the HTTP layer.
+type handshakingTLSListener struct {
+	net.Listener
+	metrics *metrics.Registry
+}
+
+func (l *handshakingTLSListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			if l.metrics != nil {
+				l.metrics.IncTLSHandshakeFailure()
+			}
+			conn.Close()
+			continue
+		}
+		return tlsConn, nil
+	}
+}
+
+func (l *HTTPListener) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	l.mu.RLock()
+	hr := l.table.find(host)
+	l.mu.RUnlock()
+
+	if hr != nil && hr.route.Certificate != nil {
+		cert, err := tls.X509KeyPair([]byte(hr.route.Certificate.Cert), []byte(hr.route.Certificate.Key))
+		if err == nil {
+			return &cert, nil
+		}
+	}
+	return &l.keypair, nil
+}
+
+func (l *HTTPListener) serveHTTP(useTLS bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor >= 2 && strings.EqualFold(req.Header.Get("Upgrade"), "websocket") && req.Method != http.MethodConnect {
+			// A websocket handshake via the HTTP/1.1 Upgrade mechanism
+			// is meaningless over HTTP/2; RFC 8441 extended CONNECT
+			// (method CONNECT) is the only supported way to tunnel a
+			// websocket on an h2 connection.
+			http.Error(w, "Upgrade is not supported over HTTP/2; use RFC 8441 extended CONNECT", http.StatusBadRequest)
+			return
+		}
+
+		host := hostWithoutPort(strings.ToLower(req.Host))
+
+		l.mu.RLock()
+		hr := l.table.findPath(host, req)
+		l.mu.RUnlock()
+
+		if hr == nil {
+			if l.Metrics != nil {
+				finish := l.Metrics.BeginRequest(metrics.RequestLabels{Route: metrics.UnmatchedRouteLabel})
+				defer func() { finish(http.StatusNotFound, req.Method, 0) }()
+			}
+			http.NotFound(w, req)
+			return
+		}
+
+		l.setForwardedHeaders(req, useTLS, hr)
+
+		serve := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if l.Metrics == nil {
+				hr.proxy.ServeHTTP(w, req)
+				return
+			}
+
+			labels := metrics.RequestLabels{Route: hr.route.ID, Domain: hr.route.Domain, Service: hr.route.Service}
+			finish := l.Metrics.BeginRequest(labels)
+			start := time.Now()
+			mw := &metricsResponseWriter{ResponseWriter: w}
+			hr.proxy.ServeHTTP(mw, req)
+			// A hijacked (Upgrade) response never calls WriteHeader through
+			// mw, so its status is reported as a 101 once the tunnelled
+			// connection this call blocked on has closed.
+			status := mw.status
+			if status == 0 {
+				status = http.StatusSwitchingProtocols
+			}
+			finish(status, req.Method, time.Since(start))
+		})
+
+		if l.AccessLog == nil {
+			serve.ServeHTTP(w, req)
+			return
+		}
+		labels := proxy.RequestLabels{RouteID: hr.route.ID, Service: hr.route.Service}
+		l.AccessLog.Wrap(labels, serve).ServeHTTP(w, req)
+	}
+}
+
+// metricsResponseWriter records the status code a handler wrote while
+// passing through the optional interfaces (Hijacker, Flusher,
+// CloseNotifier) that the proxy and its backends rely on.
+type metricsResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *metricsResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *metricsResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *metricsResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *metricsResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *metricsResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
+
+// setForwardedHeaders sets the X-Forwarded-*, X-Request-Id and
+// X-Request-Start headers the backend sees. If the request's immediate
+// peer is trusted (see isTrustedPeer), a forwarded chain it already
+// carries is extended rather than replaced and its X-Request-Id is kept
+// if it matches requestIDPattern (and replaced with a new one if not);
+// otherwise every forwarded header is overwritten from the
+// observed connection so an untrusted client can't forge them. A route
+// with ForwardedHeaders set to ForwardedHeadersStrip instead has every
+// forwarded header removed outright, for backends that must never see
+// them.
+func (l *HTTPListener) setForwardedHeaders(req *http.Request, useTLS bool, hr *httpRoute) {
+	if hr != nil && hr.route.ForwardedHeaders == router.ForwardedHeadersStrip {
+		req.Header.Del("X-Forwarded-For")
+		req.Header.Del("X-Forwarded-Proto")
+		req.Header.Del("X-Forwarded-Port")
+		req.Header.Del("X-Forwarded-Host")
+		req.Header.Del("Forwarded")
+		req.Header.Del("X-Request-Id")
+		req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+		stripHopByHopHeaders(req.Header)
+		return
+	}
+
+	ip, port := splitHostPort(req.RemoteAddr)
+	proto := "http"
+	if useTLS {
+		proto = "https"
+	}
+	trusted := l.isTrustedPeer(ip, hr)
+
+	if trusted {
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+ip)
+		} else {
+			req.Header.Set("X-Forwarded-For", ip)
+		}
+		if req.Header.Get("X-Forwarded-Proto") == "" {
+			req.Header.Set("X-Forwarded-Proto", proto)
+		}
+		if req.Header.Get("X-Forwarded-Port") == "" {
+			req.Header.Set("X-Forwarded-Port", port)
+		}
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
+	} else {
+		req.Header.Set("X-Forwarded-For", ip)
+		req.Header.Set("X-Forwarded-Proto", proto)
+		req.Header.Set("X-Forwarded-Port", port)
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+
+	if l.EmitForwardedHeader {
+		setForwardedHeader(req, ip, proto, trusted)
+	}
+
+	req.Header.Set("X-Request-Start", strconv.FormatInt(time.Now().UnixNano()/int64(time.Millisecond), 10))
+
+	id := req.Header.Get("X-Request-Id")
+	if !trusted || !requestIDPattern.MatchString(id) {
+		id = proxy.NewRequestID()
+	}
+	req.Header.Set("X-Request-Id", id)
+
+	stripHopByHopHeaders(req.Header)
+}
+
+// isTrustedPeer reports whether ip, the immediate peer's address,
+// should be trusted to supply forwarded headers: either it falls within
+// one of TrustedProxies, or the matched route opts in regardless via
+// TrustForwardHeader.
+func (l *HTTPListener) isTrustedPeer(ip string, hr *httpRoute) bool {
+	if hr != nil && hr.route.TrustForwardHeader {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, cidr := range l.TrustedProxies {
+		if cidr.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// setForwardedHeader appends this hop to the request's RFC 7239
+// Forwarded header. A malformed prior value (from an untrusted peer, or
+// one this router doesn't recognize as valid) is discarded rather than
+// propagated.
+func setForwardedHeader(req *http.Request, ip, proto string, trusted bool) {
+	hop := fmt.Sprintf("for=%s;proto=%s", forwardedNode(ip), proto)
+
+	prior := req.Header.Get("Forwarded")
+	if trusted && prior != "" && isValidForwardedHeader(prior) {
+		req.Header.Set("Forwarded", prior+", "+hop)
+	} else {
+		req.Header.Set("Forwarded", hop)
+	}
+}
+
+// forwardedNode quotes ip per RFC 7239 if it's an IPv6 literal.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// isValidForwardedHeader does a light sanity check on a client-supplied
+// Forwarded header before it's extended, rejecting values that aren't
+// of the comma-separated "key=value;key=value" shape this router emits.
+func isValidForwardedHeader(v string) bool {
+	for _, hop := range strings.Split(v, ",") {
+		for _, pair := range strings.Split(hop, ";") {
+			if !strings.Contains(pair, "=") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stripHopByHopHeaders removes Transfer-Encoding unconditionally, and
+// removes Upgrade plus any headers named in Connection unless the
+// request is itself an Upgrade request, in which case they're left
+// intact for the proxy to tunnel.
+func stripHopByHopHeaders(h http.Header) {
+	h.Del("Transfer-Encoding")
+
+	isUpgrade := false
+	var tokens []string
+	for _, v := range strings.Split(h.Get("Connection"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		tokens = append(tokens, v)
+		if strings.EqualFold(v, "upgrade") {
+			isUpgrade = true
+		}
+	}
+	if isUpgrade {
+		return
+	}
+	h.Del("Upgrade")
+	for _, tok := range tokens {
+		h.Del(tok)
+	}
+}
+
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func splitHostPort(addr string) (host, port string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
+
+func mustPortFromAddr(addr string) string {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		panic(fmt.Sprintf("router: invalid addr %q: %s", addr, err))
+	}
+	return port
+}
+
+// proxyProtocolListener wraps a net.Listener, optionally stripping a
+// PROXY protocol v1 header off each accepted connection and rewriting
+// RemoteAddr to the address it carries.
+type proxyProtocolListener struct {
+	net.Listener
+	enabled bool
+}
+
+func (p *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := p.Listener.Accept()
+	if err != nil || !p.enabled {
+		return conn, err
+	}
+	return newProxyProtocolConn(conn)
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	r          *bufio.Reader
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxyProtocolConn) RemoteAddr() net.Addr       { return c.remoteAddr }
+
+func newProxyProtocolConn(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(strings.TrimSpace(line))
+	// PROXY TCP4 srcIP dstIP srcPort dstPort
+	if len(fields) < 6 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy: invalid PROXY protocol header %q", line)
+	}
+	port, _ := strconv.Atoi(fields[4])
+	addr := &net.TCPAddr{IP: net.ParseIP(fields[2]), Port: port}
+	return &proxyProtocolConn{Conn: conn, remoteAddr: addr, r: r}, nil
+}
+
+// domainTable is the routing table used to find a route for a given
+// Host header, honoring exact, wildcard and catch-all domains plus
+// longest-prefix path matching within a domain.
+type domainTable struct {
+	exact     map[string]*domainEntry
+	wildcards []*domainEntry
+	catchAll  *domainEntry
+}
+
+type domainEntry struct {
+	domain string
+	paths  []*httpRoute
+}
+
+func (t *domainTable) set(route *router.Route, hr *httpRoute) {
+	domain := strings.ToLower(route.Domain)
+	path := normalizePath(route.Path)
+
+	var e *domainEntry
+	switch {
+	case domain == "*":
+		if t.catchAll == nil {
+			t.catchAll = &domainEntry{domain: domain}
+		}
+		e = t.catchAll
+	case strings.HasPrefix(domain, "*."):
+		for _, w := range t.wildcards {
+			if w.domain == domain {
+				e = w
+				break
+			}
+		}
+		if e == nil {
+			e = &domainEntry{domain: domain}
+			t.wildcards = append(t.wildcards, e)
+			sortWildcardsByLength(t.wildcards)
+		}
+	default:
+		if t.exact == nil {
+			t.exact = make(map[string]*domainEntry)
+		}
+		e, ok := t.exact[domain]
+		if !ok {
+			e = &domainEntry{domain: domain}
+			t.exact[domain] = e
+		}
+		t.setPath(e, path, hr)
+		return
+	}
+	t.setPath(e, path, hr)
+}
+
+func (t *domainTable) setPath(e *domainEntry, path string, hr *httpRoute) {
+	for i, existing := range e.paths {
+		if existing.route.ID == hr.route.ID {
+			e.paths[i] = hr
+			return
+		}
+	}
+	e.paths = append(e.paths, hr)
+	sortRulesBySpecificity(e.paths)
+	_ = path
+}
+
+func (t *domainTable) remove(hr *httpRoute) {
+	remove := func(e *domainEntry) bool {
+		for i, existing := range e.paths {
+			if existing.route.ID == hr.route.ID {
+				e.paths = append(e.paths[:i], e.paths[i+1:]...)
+				return true
+			}
+		}
+		return false
+	}
+	if t.catchAll != nil {
+		remove(t.catchAll)
+	}
+	for _, w := range t.wildcards {
+		remove(w)
+	}
+	for _, e := range t.exact {
+		remove(e)
+	}
+}
+
+func (t *domainTable) find(host string) *httpRoute {
+	return t.findPath(host, nil)
+}
+
+// findPath looks up the route for host and req's path, evaluating each
+// candidate's Match rules against req. req may be nil (e.g. during the
+// TLS handshake, before a request line has been read), in which case
+// only Domain/Path are considered.
+func (t *domainTable) findPath(host string, req *http.Request) *httpRoute {
+	reqPath := "/"
+	if req != nil {
+		reqPath = req.URL.Path
+	}
+	if e, ok := t.exact[host]; ok {
+		if hr := matchPath(e, reqPath, req); hr != nil {
+			return hr
+		}
+	}
+	for _, w := range t.wildcards {
+		suffix := strings.TrimPrefix(w.domain, "*")
+		if strings.HasSuffix(host, suffix) {
+			if hr := matchPath(w, reqPath, req); hr != nil {
+				return hr
+			}
+		}
+	}
+	if t.catchAll != nil {
+		return matchPath(t.catchAll, reqPath, req)
+	}
+	return nil
+}
+
+// matchPath returns the first rule in e, in specificity order, whose
+// path prefix and (if configured) Match predicate both accept reqPath/req.
+func matchPath(e *domainEntry, reqPath string, req *http.Request) *httpRoute {
+	for _, hr := range e.paths {
+		p := normalizePath(rulePath(hr))
+		if p != "" {
+			trimmed := strings.TrimSuffix(p, "/")
+			if reqPath != trimmed && !strings.HasPrefix(reqPath, p) {
+				continue
+			}
+		}
+		if !hr.match.matches(req) {
+			continue
+		}
+		return hr
+	}
+	return nil
+}
+
+// rulePath is the path prefix a rule is matched against: its Match's
+// PathPrefix if configured, otherwise the route's own Path.
+func rulePath(hr *httpRoute) string {
+	if hr.match != nil && hr.match.pathPrefix != "" {
+		return hr.match.pathPrefix
+	}
+	return hr.route.Path
+}
+
+func normalizePath(p string) string {
+	if p == "" {
+		return ""
+	}
+	if !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// sortRulesBySpecificity orders routes within a domain so the most
+// specific is tried first: longest path prefix wins, ties broken by the
+// rule's explicit Match.Weight (highest first).
+func sortRulesBySpecificity(routes []*httpRoute) {
+	less := func(a, b *httpRoute) bool {
+		pa, pb := len(rulePath(a)), len(rulePath(b))
+		if pa != pb {
+			return pa > pb
+		}
+		return weight(a) > weight(b)
+	}
+	for i := 1; i < len(routes); i++ {
+		for j := i; j > 0 && less(routes[j], routes[j-1]); j-- {
+			routes[j], routes[j-1] = routes[j-1], routes[j]
+		}
+	}
+}
+
+func weight(hr *httpRoute) int {
+	if hr.match == nil {
+		return 0
+	}
+	return hr.match.weight
+}
+
+func sortWildcardsByLength(entries []*domainEntry) {
+	for i := 1; i < len(entries); i++ {
+		for j := i; j > 0 && len(entries[j].domain) > len(entries[j-1].domain); j-- {
+			entries[j], entries[j-1] = entries[j-1], entries[j]
+		}
+	}
+}
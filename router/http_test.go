@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,11 +18,15 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
 	discoverd "github.com/flynn/flynn/discoverd/client"
 	"github.com/flynn/flynn/discoverd/testutil"
 	"github.com/flynn/flynn/pkg/httpclient"
+	"github.com/flynn/flynn/router/metrics"
 	"github.com/flynn/flynn/router/proxy"
 	"github.com/flynn/flynn/router/testutils"
 	router "github.com/flynn/flynn/router/types"
@@ -42,6 +49,13 @@ func httpTestHandler(id string) http.Handler {
 	})
 }
 
+func httpTestSlowHandler(id string, delay time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte(id))
+	})
+}
+
 func newHTTPClient(serverName string) *http.Client {
 	cert := testutils.TLSConfigForDomain(serverName)
 	pool := x509.NewCertPool()
@@ -284,6 +298,16 @@ func assertGet(c *C, url, host, expected string) []*http.Cookie {
 	return assertGetCookies(c, url, host, expected, nil)
 }
 
+// assertGetStatus performs a GET and asserts only its status code, for
+// cases (e.g. a tripped circuit breaker) where the response body isn't
+// interesting.
+func assertGetStatus(c *C, url, host string, expectedStatus int) *http.Response {
+	res, err := newHTTPClient(host).Do(newReq(url, host))
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, expectedStatus)
+	return res
+}
+
 func assertGetCookies(c *C, url, host, expected string, cookies []*http.Cookie) []*http.Cookie {
 	req := newReq(url, host)
 	for _, cookie := range cookies {
@@ -458,6 +482,67 @@ func (s *S) TestPathRouting(c *C) {
 	assertGet(c, "http://"+l.Addrs[0]+"/3/", "foo.bar", "3")
 }
 
+func (s *S) TestHeaderAndMethodRouting(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	srv3 := httptest.NewServer(httpTestHandler("3"))
+	defer srv1.Close()
+	defer srv2.Close()
+	defer srv3.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	// canary: requests carrying X-Canary: true go to service 2, everyone
+	// else falls through to the default route for the domain.
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "foo.bar",
+		Service: "2",
+		Match: &router.Match{
+			Headers: map[string]string{"X-Canary": "true"},
+			Weight:  1,
+		},
+	}.ToRoute())
+	// method-scoped: POSTs go to service 3.
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "foo.bar",
+		Service: "3",
+		Match: &router.Match{
+			Methods: []string{"POST"},
+			Weight:  1,
+		},
+	}.ToRoute())
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "foo.bar",
+		Service: "1",
+	}.ToRoute())
+
+	discoverdRegisterHTTPService(c, l, "1", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "2", srv2.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "3", srv3.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addrs[0], "foo.bar", "1")
+
+	req := newReq("http://"+l.Addrs[0], "foo.bar")
+	req.Header.Set("X-Canary", "true")
+	res, err := newHTTPClient("foo.bar").Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "2")
+
+	req, err = http.NewRequest("POST", "http://"+l.Addrs[0], nil)
+	c.Assert(err, IsNil)
+	req.Host = "foo.bar"
+	res, err = newHTTPClient("foo.bar").Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	data, err = ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "3")
+}
+
 func (s *S) TestHTTPInitialSync(c *C) {
 	l := s.newHTTPListener(c)
 	s.addHTTPRoute(c, l)
@@ -565,11 +650,16 @@ func (s *S) TestHTTPServiceHandlerBackendConnectionClosed(c *C) {
 
 // Act as an app to test HTTP headers
 func httpHeaderTestHandler(c *C, ip, port string) http.Handler {
+	return httpHeaderTestHandlerProto(c, ip, port, "http")
+}
+
+func httpHeaderTestHandlerProto(c *C, ip, port, proto string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		c.Assert(req.Header["X-Forwarded-Port"][0], Equals, port)
-		c.Assert(req.Header["X-Forwarded-Proto"][0], Equals, "http")
+		c.Assert(req.Header["X-Forwarded-Proto"][0], Equals, proto)
 		c.Assert(len(req.Header["X-Request-Start"][0]), Equals, 13)
 		c.Assert(req.Header["X-Forwarded-For"][0], Equals, ip)
+		c.Assert(req.Header["X-Forwarded-Host"][0], Equals, req.Host)
 		c.Assert(req.Header["X-Request-Id"][0], Matches, UUIDRegex)
 		w.Write([]byte("1"))
 	})
@@ -590,6 +680,28 @@ func (s *S) TestHTTPHeaders(c *C) {
 	assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
 }
 
+// TestHTTPSHeaders checks that a request arriving over TLS gets
+// X-Forwarded-Proto: https, as opposed to TestHTTPHeaders' plaintext
+// "http".
+func (s *S) TestHTTPSHeaders(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	port := mustPortFromAddr(l.listeners[1].Addr().String())
+	srv := httptest.NewServer(httpHeaderTestHandlerProto(c, "127.0.0.1", port, "https"))
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "https://"+l.TLSAddrs[0], "example.com", "1")
+}
+
+// TestHTTPHeadersFromClient checks that an untrusted peer (the default,
+// since no TrustedProxies are configured) has its forwarded headers and
+// X-Request-Id overwritten from scratch rather than extended, so it
+// can't forge a chain that makes its request look like it arrived
+// through a trusted hop.
 func (s *S) TestHTTPHeadersFromClient(c *C) {
 	l := s.newHTTPListener(c)
 	defer l.Close()
@@ -597,12 +709,13 @@ func (s *S) TestHTTPHeadersFromClient(c *C) {
 	s.addHTTPRoute(c, l)
 
 	port := mustPortFromAddr(l.listeners[0].Addr().String())
-	srv := httptest.NewServer(httpHeaderTestHandler(c, "192.168.1.1, 127.0.0.1", port))
+	srv := httptest.NewServer(httpHeaderTestHandler(c, "127.0.0.1", port))
 
 	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
 
 	req := newReq("http://"+l.Addrs[0], "example.com")
 	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
 	req.Header.Set("X-Request-Id", "asdf1234asdf")
 	res, err := httpClient.Do(req)
 	c.Assert(err, IsNil)
@@ -610,6 +723,113 @@ func (s *S) TestHTTPHeadersFromClient(c *C) {
 	c.Assert(res.StatusCode, Equals, 200)
 }
 
+// TestHTTPHeadersFromTrustedProxy checks that a peer within
+// TrustedProxies has its forwarded chain extended and its
+// client-supplied X-Forwarded-Proto/X-Request-Id preserved.
+func (s *S) TestHTTPHeadersFromTrustedProxy(c *C) {
+	l := s.newHTTPListener(c)
+	_, loopback, err := net.ParseCIDR("127.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.TrustedProxies = []net.IPNet{*loopback}
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Header.Get("X-Forwarded-For"), Equals, "192.168.1.1, 127.0.0.1")
+		c.Assert(req.Header.Get("X-Forwarded-Proto"), Equals, "https")
+		c.Assert(req.Header.Get("X-Forwarded-Host"), Equals, "original.example.com")
+		c.Assert(req.Header.Get("X-Request-Id"), Equals, "asdf1234asdf5678")
+		w.Write([]byte("1"))
+	})
+	srv := httptest.NewServer(h)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "original.example.com")
+	req.Header.Set("X-Request-Id", "asdf1234asdf5678")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
+// TestHTTPForwardedHeaderFromTrustedProxy checks the RFC 7239 Forwarded
+// header emitter: a trusted peer's well-formed chain is extended, and a
+// malformed one is discarded in favor of just this hop.
+func (s *S) TestHTTPForwardedHeaderFromTrustedProxy(c *C) {
+	l := s.newHTTPListener(c)
+	_, loopback, err := net.ParseCIDR("127.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.TrustedProxies = []net.IPNet{*loopback}
+	l.EmitForwardedHeader = true
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	for _, t := range []struct {
+		prior    string
+		expected string
+	}{
+		{"for=192.168.1.1;proto=https", "for=192.168.1.1;proto=https, for=127.0.0.1;proto=http"},
+		{"garbage; not a forwarded header", "for=127.0.0.1;proto=http"},
+	} {
+		h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			c.Assert(req.Header.Get("Forwarded"), Equals, t.expected)
+			w.Write([]byte("1"))
+		})
+		srv := httptest.NewServer(h)
+
+		discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+		req := newReq("http://"+l.Addrs[0], "example.com")
+		req.Header.Set("Forwarded", t.prior)
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		res.Body.Close()
+
+		srv.Close()
+	}
+}
+
+// TestForwardedHeadersStrip checks that a route with ForwardedHeaders
+// set to ForwardedHeadersStrip has every forwarded header removed
+// rather than set, even when the peer would otherwise be trusted.
+func (s *S) TestForwardedHeadersStrip(c *C) {
+	l := s.newHTTPListener(c)
+	_, loopback, err := net.ParseCIDR("127.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.TrustedProxies = []net.IPNet{*loopback}
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:           "example.com",
+		Service:          "test",
+		ForwardedHeaders: router.ForwardedHeadersStrip,
+	}.ToRoute())
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Port", "X-Forwarded-Host", "Forwarded", "X-Request-Id"} {
+			c.Assert(req.Header.Get(name), Equals, "")
+		}
+		w.Write([]byte("1"))
+	})
+	srv := httptest.NewServer(h)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Forwarded-For", "192.168.1.1")
+	req.Header.Set("X-Request-Id", "asdf1234asdf5678")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+}
+
 func (s *S) TestClientProvidedRequestID(c *C) {
 	l := s.newHTTPListener(c)
 	defer l.Close()
@@ -954,135 +1174,431 @@ func (s *S) TestStickyHTTPRoute(c *C) {
 	}
 }
 
-func wsHandshakeTestHandler(id string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
-			w.Header().Set("Connection", "Upgrade")
-			w.Header().Set("Upgrade", "websocket")
-			w.Header().Set("Backend-Id", id)
-			w.WriteHeader(http.StatusSwitchingProtocols)
-		} else {
-			http.NotFound(w, req)
-		}
-	})
-}
-
-func (s *S) TestStickyHTTPRouteWebsocket(c *C) {
-	srv1 := httptest.NewServer(wsHandshakeTestHandler("1"))
-	srv2 := httptest.NewServer(wsHandshakeTestHandler("2"))
-	defer srv1.Close()
-	defer srv2.Close()
+// TestStickyCookieDefaults tests that the sticky cookie's default
+// attributes match the proxy's pre-existing hardcoded behavior: Secure
+// tracks whether the request arrived over TLS, HttpOnly is always set,
+// and SameSite defaults to Lax.
+func (s *S) TestStickyCookieDefaults(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
 
 	l := s.newHTTPListener(c)
-	url := "http://" + l.Addrs[0]
 	defer l.Close()
 
 	s.addStickyHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
 
-	var unregister func()
-	steps := []struct {
-		do        func()
-		backend   string
-		setCookie bool
-	}{
-		// step 1: register srv1, assert requests to srv1
-		{
-			do:        func() { unregister = discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String()) },
-			backend:   "1",
-			setCookie: true,
-		},
-		// step 2: register srv2, assert requests stay with srv1
-		{
-			do:      func() { discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String()) },
-			backend: "1",
-		},
-		// step 3: unregister srv1, assert requests switch to srv2
-		{
-			do:        func() { unregister() },
-			backend:   "2",
-			setCookie: true,
-		},
-	}
-
-	var sessionCookies []*http.Cookie
-	for _, step := range steps {
-		step.do()
-
-		cookieSet := false
-		for i := 0; i < 10; i++ {
-			req := newReq(url, "example.com")
-			for _, cookie := range sessionCookies {
-				req.AddCookie(cookie)
-			}
-			req.Header.Set("Connection", "Upgrade")
-			req.Header.Set("Upgrade", "websocket")
-			res, err := httpClient.Do(req)
-			c.Assert(err, IsNil)
-			defer res.Body.Close()
-
-			c.Assert(err, IsNil)
-			c.Assert(res.StatusCode, Equals, 101)
-			c.Assert(res.Header.Get("Backend-Id"), Equals, step.backend)
-
-			// reuse the session cookie if present
-			if len(res.Cookies()) > 0 {
-				// TODO(benburkert): instead of assuming that a session cookie is set
-				// if a response has cookies, switch back to checking for the session
-				// cookie once this test can access proxy.stickyCookie
-				sessionCookies = res.Cookies()
-				cookieSet = true
+	findStickyCookie := func(cookies []*http.Cookie) *http.Cookie {
+		for _, cookie := range cookies {
+			if cookie.Name == proxy.StickyCookieName {
+				return cookie
 			}
 		}
-
-		c.Assert(cookieSet, Equals, step.setCookie)
-
-		httpClient.Transport.(*http.Transport).CloseIdleConnections()
+		return nil
 	}
+
+	plain := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+	cookie := findStickyCookie(plain)
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Secure, Equals, false)
+	c.Assert(cookie.HttpOnly, Equals, true)
+	c.Assert(cookie.SameSite, Equals, http.SameSiteLaxMode)
+	c.Assert(cookie.Path, Equals, "/")
+
+	tlsCookies := assertGet(c, "https://"+l.TLSAddrs[0], "example.com", "1")
+	cookie = findStickyCookie(tlsCookies)
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Secure, Equals, true)
+	c.Assert(cookie.HttpOnly, Equals, true)
 }
 
-func (s *S) TestNoBackends(c *C) {
+// TestStickyCookieConfig tests that a route's StickyCookie overrides
+// each attribute of the emitted cookie.
+func (s *S) TestStickyCookieConfig(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
 	l := s.newHTTPListener(c)
 	defer l.Close()
 
+	insecure := false
+	notHTTPOnly := false
 	s.addRoute(c, l, router.HTTPRoute{
 		Domain:  "example.com",
-		Service: "example-com",
+		Service: "test",
+		Sticky:  true,
+		StickyCookie: &router.StickyCookie{
+			Name:     "affinity",
+			Path:     "/app",
+			Domain:   "example.com",
+			MaxAge:   3600,
+			Secure:   &insecure,
+			HTTPOnly: &notHTTPOnly,
+			SameSite: router.StickyCookieSameSiteStrict,
+		},
 	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
 
-	req := newReq("http://"+l.Addrs[0], "example.com")
-	res, err := newHTTPClient("example.com").Do(req)
-	c.Assert(err, IsNil)
-	defer res.Body.Close()
-
-	c.Assert(res.StatusCode, Equals, 503)
-	data, err := ioutil.ReadAll(res.Body)
-	c.Assert(err, IsNil)
-	c.Assert(string(data), Equals, "Service Unavailable\n")
+	res := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+	var cookie *http.Cookie
+	for _, ck := range res {
+		if ck.Name == "affinity" {
+			cookie = ck
+		}
+	}
+	c.Assert(cookie, NotNil)
+	c.Assert(cookie.Path, Equals, "/app")
+	c.Assert(cookie.Domain, Equals, "example.com")
+	c.Assert(cookie.MaxAge, Equals, 3600)
+	c.Assert(cookie.Secure, Equals, false)
+	c.Assert(cookie.HttpOnly, Equals, false)
+	c.Assert(cookie.SameSite, Equals, http.SameSiteStrictMode)
 }
 
-func (s *S) TestNoResponsiveBackends(c *C) {
+// TestStickyCookieSecretsOpaque tests that, once StickyCookieSecrets is
+// configured, the sticky cookie's value no longer contains the backend's
+// address in the clear.
+func (s *S) TestStickyCookieSecretsOpaque(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
 	l := s.newHTTPListener(c)
 	defer l.Close()
+	l.StickyCookieSecrets = [][]byte{[]byte("secret-a")}
 
-	// close both servers immediately
+	s.addStickyHTTPRoute(c, l)
+	addr := srv.Listener.Addr().String()
+	discoverdRegisterHTTP(c, l, addr)
+
+	cookies := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+	c.Assert(cookies, HasLen, 1)
+	c.Assert(strings.Contains(cookies[0].Value, addr), Equals, false)
+}
+
+// TestStickyCookieSecretsRotation tests that a sticky cookie signed under
+// a secret still present in StickyCookieSecrets continues to pin its
+// request to the same backend, even once a newer secret has been
+// prepended for signing new cookies.
+func (s *S) TestStickyCookieSecretsRotation(c *C) {
 	srv1 := httptest.NewServer(httpTestHandler("1"))
-	srv1.Close()
 	srv2 := httptest.NewServer(httpTestHandler("2"))
-	srv2.Close()
+	defer srv1.Close()
+	defer srv2.Close()
 
-	s.addRoute(c, l, router.HTTPRoute{
-		Domain:  "example.com",
-		Service: "example-com",
-		Sticky:  true,
-	}.ToRoute())
-	discoverdRegisterHTTPService(c, l, "example-com", srv1.Listener.Addr().String())
-	discoverdRegisterHTTPService(c, l, "example-com", srv2.Listener.Addr().String())
+	l := s.newHTTPListener(c)
+	defer l.Close()
+	l.StickyCookieSecrets = [][]byte{[]byte("secret-a")}
 
-	type ts struct{ upgrade bool }
-	tests := []ts{
-		{upgrade: false}, // regular path
-		{upgrade: true},  // tcp/websocket path
-	}
+	s.addStickyHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+
+	cookies := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	l.StickyCookieSecrets = [][]byte{[]byte("secret-b"), []byte("secret-a")}
+
+	for i := 0; i < 10; i++ {
+		resCookies := assertGetCookies(c, "http://"+l.Addrs[0], "example.com", "1", cookies)
+		c.Assert(resCookies, HasLen, 0)
+	}
+}
+
+// TestStickyCookieSecretsRejectsOldKey tests that a sticky cookie signed
+// under a secret no longer present in StickyCookieSecrets is treated as a
+// sticky miss: the request falls back to ordinary load balancing (rather
+// than erroring) and a freshly signed cookie is issued.
+func (s *S) TestStickyCookieSecretsRejectsOldKey(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+	l.StickyCookieSecrets = [][]byte{[]byte("secret-a")}
+
+	s.addStickyHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	cookies := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+
+	l.StickyCookieSecrets = [][]byte{[]byte("secret-b")}
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	res, err := newHTTPClient("example.com").Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	rerouted := res.Cookies()
+	c.Assert(rerouted, Not(HasLen), 0)
+	c.Assert(rerouted[0].Value, Not(Equals), cookies[0].Value)
+}
+
+// TestStickinessModeApplicationCookie tests that, under
+// StickinessModeApplicationCookie, requests are pinned by watching the
+// backend's own session cookie rather than one the proxy sets itself.
+func (s *S) TestStickinessModeApplicationCookie(c *C) {
+	appBackend := func(sessionValue, id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "JSESSIONID", Value: sessionValue})
+			w.Write([]byte(id))
+		}))
+	}
+	srv1 := appBackend("session-1", "1")
+	srv2 := appBackend("session-2", "2")
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:         "example.com",
+		Service:        "test",
+		Sticky:         true,
+		StickinessMode: router.StickinessModeApplicationCookie,
+	}.ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	get := func(cookies ...*http.Cookie) (string, []*http.Cookie) {
+		req := newReq("http://"+l.Addrs[0], "example.com")
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		res, err := newHTTPClient("example.com").Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data), res.Cookies()
+	}
+
+	// The first request carries no application cookie, so it's load
+	// balanced normally; whichever backend answers sets its own session
+	// cookie, which the proxy observes so it can pin future requests
+	// carrying that value back to the same backend.
+	id, cookies := get()
+	var appCookie *http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name == "JSESSIONID" {
+			appCookie = cookie
+		}
+		c.Assert(cookie.Name, Not(Equals), proxy.StickyCookieName)
+	}
+	c.Assert(appCookie, NotNil)
+
+	for i := 0; i < 10; i++ {
+		pinnedID, pinnedCookies := get(appCookie)
+		c.Assert(pinnedID, Equals, id)
+		for _, cookie := range pinnedCookies {
+			c.Assert(cookie.Name, Not(Equals), proxy.StickyCookieName)
+		}
+	}
+}
+
+// TestStickinessModeConsistentHash tests that, under
+// StickinessModeConsistentHash, requests sharing a hash key are pinned
+// to the same backend without any cookie, and that removing a backend
+// only remaps the keys that were assigned to it.
+func (s *S) TestStickinessModeConsistentHash(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	srv3 := httptest.NewServer(httpTestHandler("3"))
+	defer srv1.Close()
+	defer srv2.Close()
+	defer srv3.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:         "example.com",
+		Service:        "test",
+		Sticky:         true,
+		StickinessMode: router.StickinessModeConsistentHash,
+		HashKey:        "header:X-Session-Key",
+	}.ToRoute())
+
+	unregister1 := discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv3.Listener.Addr().String())
+
+	getFor := func(key string) string {
+		req := newReq("http://"+l.Addrs[0], "example.com")
+		req.Header.Set("X-Session-Key", key)
+		res, err := newHTTPClient("example.com").Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(data)
+	}
+
+	keys := make([]string, 20)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("session-%d", i)
+	}
+
+	before := make(map[string]string, len(keys))
+	for _, key := range keys {
+		id := getFor(key)
+		before[key] = id
+		for i := 0; i < 3; i++ {
+			c.Assert(getFor(key), Equals, id)
+		}
+	}
+
+	unregister1()
+
+	changed := 0
+	for _, key := range keys {
+		id := getFor(key)
+		if id != before[key] {
+			changed++
+			c.Assert(before[key], Equals, "1")
+		} else {
+			c.Assert(before[key], Not(Equals), "1")
+		}
+	}
+	c.Assert(changed, Not(Equals), 0)
+}
+
+func wsHandshakeTestHandler(id string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.ToLower(req.Header.Get("Connection")) == "upgrade" {
+			w.Header().Set("Connection", "Upgrade")
+			w.Header().Set("Upgrade", "websocket")
+			w.Header().Set("Backend-Id", id)
+			w.WriteHeader(http.StatusSwitchingProtocols)
+		} else {
+			http.NotFound(w, req)
+		}
+	})
+}
+
+func (s *S) TestStickyHTTPRouteWebsocket(c *C) {
+	srv1 := httptest.NewServer(wsHandshakeTestHandler("1"))
+	srv2 := httptest.NewServer(wsHandshakeTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	url := "http://" + l.Addrs[0]
+	defer l.Close()
+
+	s.addStickyHTTPRoute(c, l)
+
+	var unregister func()
+	steps := []struct {
+		do        func()
+		backend   string
+		setCookie bool
+	}{
+		// step 1: register srv1, assert requests to srv1
+		{
+			do:        func() { unregister = discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String()) },
+			backend:   "1",
+			setCookie: true,
+		},
+		// step 2: register srv2, assert requests stay with srv1
+		{
+			do:      func() { discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String()) },
+			backend: "1",
+		},
+		// step 3: unregister srv1, assert requests switch to srv2
+		{
+			do:        func() { unregister() },
+			backend:   "2",
+			setCookie: true,
+		},
+	}
+
+	var sessionCookies []*http.Cookie
+	for _, step := range steps {
+		step.do()
+
+		cookieSet := false
+		for i := 0; i < 10; i++ {
+			req := newReq(url, "example.com")
+			for _, cookie := range sessionCookies {
+				req.AddCookie(cookie)
+			}
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			res, err := httpClient.Do(req)
+			c.Assert(err, IsNil)
+			defer res.Body.Close()
+
+			c.Assert(err, IsNil)
+			c.Assert(res.StatusCode, Equals, 101)
+			c.Assert(res.Header.Get("Backend-Id"), Equals, step.backend)
+
+			// reuse the session cookie if present
+			if len(res.Cookies()) > 0 {
+				// TODO(benburkert): instead of assuming that a session cookie is set
+				// if a response has cookies, switch back to checking for the session
+				// cookie once this test can access proxy.stickyCookie
+				sessionCookies = res.Cookies()
+				cookieSet = true
+			}
+		}
+
+		c.Assert(cookieSet, Equals, step.setCookie)
+
+		httpClient.Transport.(*http.Transport).CloseIdleConnections()
+	}
+}
+
+func (s *S) TestNoBackends(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "example-com",
+	}.ToRoute())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	res, err := newHTTPClient("example.com").Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+
+	c.Assert(res.StatusCode, Equals, 503)
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, "Service Unavailable\n")
+}
+
+func (s *S) TestNoResponsiveBackends(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	// close both servers immediately
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	srv2.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "example-com",
+		Sticky:  true,
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "example-com", srv1.Listener.Addr().String())
+	discoverdRegisterHTTPService(c, l, "example-com", srv2.Listener.Addr().String())
+
+	type ts struct{ upgrade bool }
+	tests := []ts{
+		{upgrade: false}, // regular path
+		{upgrade: true},  // tcp/websocket path
+	}
 
 	runTest := func(test ts) {
 		c.Log("upgrade:", test.upgrade)
@@ -1342,23 +1858,120 @@ func (s *S) TestDefaultServerKeypair(c *C) {
 	assertGet(c, "https://"+l.TLSAddrs[0], "foo.example.com", "2")
 }
 
-func (s *S) TestCaseInsensitiveDomain(c *C) {
-	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		w.Write([]byte(req.Host))
-	}))
+// TestHTTPSBackend checks that a route with BackendTLS.Enabled dials its
+// backend over TLS: without the backend's CA pinned the connection is
+// untrusted and the request fails the same way any unreachable backend
+// does, while pinning the CA (and setting ServerName to match the
+// backend's certificate) succeeds.
+func (s *S) TestHTTPSBackend(c *C) {
+	srv := httptest.NewTLSServer(httpTestHandler("1"))
 	defer srv.Close()
 
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
 	l := s.newHTTPListener(c)
 	defer l.Close()
 
-	s.addRoute(c, l, router.HTTPRoute{
-		Domain:  "exaMple.com",
-		Service: "example-com",
-	}.ToRoute())
+	route := router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		BackendTLS: &router.BackendTLS{
+			Enabled:    true,
+			ServerName: "example.com",
+		},
+	}.ToRoute()
+	s.addRoute(c, l, route)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
 
-	discoverdRegisterHTTPService(c, l, "example-com", srv.Listener.Addr().String())
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 503)
 
-	assertGet(c, "http://"+l.Addrs[0], "Example.com", "Example.com")
+	route.BackendTLS.CACerts = caCert
+	s.addRoute(c, l, route)
+
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+}
+
+// TestH2Backend checks that a route with BackendProtocol set to
+// BackendProtocolH2 dials its backend over HTTP/2 even though its
+// BackendTLS block leaves Enabled unset (H2 to a backend always goes
+// over TLS; BackendTLS only customizes that connection, its Enabled
+// flag isn't required to turn TLS on).
+func (s *S) TestH2Backend(c *C) {
+	srv := httptest.NewUnstartedServer(httpTestHandler("1"))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		BackendProtocol: router.BackendProtocolH2,
+		BackendTLS: &router.BackendTLS{
+			ServerName: "example.com",
+			CACerts:    caCert,
+		},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+}
+
+// TestH2BackendWithoutBackendTLS checks that a route with
+// BackendProtocol: BackendProtocolH2 and no BackendTLS block at all
+// doesn't panic dialing its backend (regression test: backendTLSConfig
+// used to dereference a nil BackendTLS in this case).
+func (s *S) TestH2BackendWithoutBackendTLS(c *C) {
+	srv := httptest.NewUnstartedServer(httpTestHandler("1"))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		BackendProtocol: router.BackendProtocolH2,
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	// the backend's self-signed certificate isn't trusted without
+	// BackendTLS.CACerts pinning it, so the request fails the same way
+	// any unreachable backend does, rather than crashing the router.
+	c.Assert(res.StatusCode, Equals, 503)
+}
+
+func (s *S) TestCaseInsensitiveDomain(c *C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.Host))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "exaMple.com",
+		Service: "example-com",
+	}.ToRoute())
+
+	discoverdRegisterHTTPService(c, l, "example-com", srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addrs[0], "Example.com", "Example.com")
 	assertGet(c, "https://"+l.TLSAddrs[0], "ExamPle.cOm", "ExamPle.cOm")
 }
 
@@ -1382,6 +1995,151 @@ func (s *S) TestHostPortStripping(c *C) {
 	assertGet(c, "https://"+l.TLSAddrs[0], "example.com:443", "example.com:443")
 }
 
+// TestCircuitBreakerTripsAndShortCircuits tests that a backend instance
+// with a closed connection trips its circuit breaker after Threshold
+// consecutive failures, after which further requests are rejected with
+// 503 without attempting to dial it, while a healthy backend on the
+// same route continues to be served.
+func (s *S) TestCircuitBreakerTripsAndShortCircuits(c *C) {
+	// a listener that accepts and immediately closes every connection,
+	// so each request fails only after a successful dial, and accepts
+	// are counted to prove later requests never reach it at all
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	var accepts int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepts, 1)
+			conn.Close()
+		}
+	}()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "circuit-breaker-trip",
+		CircuitBreaker: &router.CircuitBreaker{
+			Threshold: 2,
+			Window:    time.Minute,
+			Cooldown:  time.Minute,
+		},
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "circuit-breaker-trip", ln.Addr().String())
+
+	// these two requests each reach the backend (dial succeeds) and
+	// fail, tripping the breaker on the second
+	for i := 0; i < 2; i++ {
+		res := assertGetStatus(c, "http://"+l.Addrs[0], "example.com", 503)
+		res.Body.Close()
+	}
+	c.Assert(int(atomic.LoadInt32(&accepts)), Equals, 2)
+
+	// further requests are short-circuited: the accept count never
+	// moves again, proving the backend isn't dialed at all
+	for i := 0; i < 3; i++ {
+		res := assertGetStatus(c, "http://"+l.Addrs[0], "example.com", 503)
+		res.Body.Close()
+	}
+	c.Assert(int(atomic.LoadInt32(&accepts)), Equals, 2)
+}
+
+// TestCircuitBreakerHalfOpenProbe tests that once a tripped breaker's
+// cooldown elapses, exactly one probe request is let through, and that
+// the probe's outcome (success here) closes the circuit for requests
+// that follow it.
+func (s *S) TestCircuitBreakerHalfOpenProbe(c *C) {
+	var healthy int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&healthy) == 0 {
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "circuit-breaker-probe",
+		CircuitBreaker: &router.CircuitBreaker{
+			Threshold: 1,
+			Window:    time.Minute,
+			Cooldown:  100 * time.Millisecond,
+		},
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "circuit-breaker-probe", srv.Listener.Addr().String())
+
+	// trip the breaker
+	res := assertGetStatus(c, "http://"+l.Addrs[0], "example.com", 503)
+	res.Body.Close()
+
+	// still within cooldown: short-circuited without ever reaching the
+	// (now healthy) backend
+	atomic.StoreInt32(&healthy, 1)
+	res = assertGetStatus(c, "http://"+l.Addrs[0], "example.com", 503)
+	res.Body.Close()
+
+	time.Sleep(150 * time.Millisecond)
+
+	// the cooldown has elapsed: the next request is let through as the
+	// half-open probe and succeeds, closing the circuit
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "ok")
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "ok")
+}
+
+// TestCircuitBreakerStickyFallback tests that a sticky route falls back
+// to another healthy backend when the one its sticky cookie names has
+// its circuit open, rather than surfacing a 503 to a client that could
+// still be served.
+func (s *S) TestCircuitBreakerStickyFallback(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "circuit-breaker-sticky",
+		Sticky:  true,
+		CircuitBreaker: &router.CircuitBreaker{
+			Threshold: 1,
+			Window:    time.Minute,
+			Cooldown:  time.Minute,
+		},
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "circuit-breaker-sticky", srv1.Listener.Addr().String())
+
+	cookies := assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+
+	// take srv1 down and trip its breaker
+	srv1.Close()
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 503)
+
+	discoverdRegisterHTTPService(c, l, "circuit-breaker-sticky", srv2.Listener.Addr().String())
+
+	// the sticky cookie still names srv1, whose circuit is now open:
+	// the request must fall back to srv2 rather than 503ing
+	assertGetCookies(c, "http://"+l.Addrs[0], "example.com", "2", cookies)
+}
+
 func (s *S) TestHTTPResponseStreaming(c *C) {
 	done := make(chan struct{})
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -1426,6 +2184,133 @@ func (s *S) TestHTTPResponseStreaming(c *C) {
 	c.Assert(string(buf), Equals, "a")
 }
 
+func (s *S) TestALPNNegotiatesHTTP2(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	cert := testutils.TLSConfigForDomain("example.com")
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(cert.Cert))
+
+	conn, err := tls.Dial("tcp", l.TLSAddrs[0], &tls.Config{
+		ServerName: "example.com",
+		RootCAs:    pool,
+		NextProtos: []string{"h2", "http/1.1"},
+	})
+	c.Assert(err, IsNil)
+	defer conn.Close()
+	c.Assert(conn.ConnectionState().NegotiatedProtocol, Equals, "h2")
+}
+
+func (s *S) TestHTTPResponseStreamingH2(c *C) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("a"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer srv.Close()
+	defer close(done)
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	client := newHTTP2Client("example.com")
+	client.Timeout = 1 * time.Second
+
+	req := newReq(fmt.Sprintf("https://%s/body", l.TLSAddrs[0]), "example.com")
+	res, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.ProtoMajor, Equals, 2)
+
+	buf := make([]byte, 1)
+	_, err = res.Body.Read(buf)
+	c.Assert(err, IsNil)
+	c.Assert(string(buf), Equals, "a")
+}
+
+func (s *S) TestStickyHTTPRouteHTTP2(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addStickyHTTPRoute(c, l)
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	client := newHTTP2Client("example.com")
+
+	// Issue the first request over a fresh connection to pick up the
+	// sticky cookie, then replay it on several concurrently-multiplexed
+	// streams over that same connection: every one of them must still
+	// land on the backend the cookie names, proving stickiness doesn't
+	// depend on a request getting its own TCP connection the way it
+	// always did before backends could be reached over HTTP/2.
+	req := newReq(fmt.Sprintf("https://%s/", l.TLSAddrs[0]), "example.com")
+	res, err := client.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	backend := string(data)
+	cookies := res.Cookies()
+	c.Assert(cookies, Not(HasLen), 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := newReq(fmt.Sprintf("https://%s/", l.TLSAddrs[0]), "example.com")
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+			res, err := client.Do(req)
+			c.Assert(err, IsNil)
+			defer res.Body.Close()
+			data, err := ioutil.ReadAll(res.Body)
+			c.Assert(err, IsNil)
+			c.Assert(string(data), Equals, backend)
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *S) TestWebsocketUpgradeRejectedOverHTTP2(c *C) {
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+
+	req := httptest.NewRequest("GET", "http://example.com/", nil)
+	req.Host = "example.com"
+	req.ProtoMajor = 2
+	req.ProtoMinor = 0
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	rec := httptest.NewRecorder()
+	l.serveHTTP(false)(rec, req)
+	c.Assert(rec.Code, Equals, http.StatusBadRequest)
+}
+
 func (s *S) TestHTTPHijackUpgrade(c *C) {
 	h := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Connection", "upgrade")
@@ -1754,3 +2639,716 @@ func (s *S) TestHTTPLoadBalance(c *C) {
 		c.Assert(string(body), Not(Equals), backendID)
 	}
 }
+
+// TestBackendDraining tests that, once a sticky route's DrainTimeout is
+// set, deregistering a backend doesn't remove it outright: requests
+// already pinned to it by a sticky cookie keep landing on it for the
+// drain window, while fresh (non-sticky) requests are routed elsewhere
+// immediately. Once the window elapses, the backend is gone entirely and
+// even the sticky cookie holder is reselected onto another backend.
+func (s *S) TestBackendDraining(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	r := s.addRoute(c, l, router.HTTPRoute{
+		Domain:       "example.com",
+		Service:      "test",
+		Sticky:       true,
+		DrainTimeout: 200 * time.Millisecond,
+	}.ToRoute())
+
+	unregisterFor := map[string]func(){
+		"1": discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String()),
+		"2": discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String()),
+	}
+
+	get := func(cookies ...*http.Cookie) (string, []*http.Cookie) {
+		req := newReq("http://"+l.Addrs[0], r.Domain)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, IsNil)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, IsNil)
+		return string(body), res.Cookies()
+	}
+
+	// pin a sticky cookie to whichever backend answers first
+	backendID, cookies := get()
+	var stickyCookie *http.Cookie
+	for _, cookie := range cookies {
+		if cookie.Name == proxy.StickyCookieName {
+			stickyCookie = cookie
+			break
+		}
+	}
+	c.Assert(stickyCookie, NotNil)
+	otherID := map[string]string{"1": "2", "2": "1"}[backendID]
+
+	unregisterFor[backendID]()
+
+	// the sticky cookie holder still reaches the deregistered backend
+	// during the drain window
+	id, _ := get(stickyCookie)
+	c.Assert(id, Equals, backendID)
+
+	// a fresh request is never routed to the deregistered backend
+	for i := 0; i < 5; i++ {
+		id, _ := get()
+		c.Assert(id, Equals, otherID)
+	}
+
+	// once the drain window elapses, the backend is gone entirely and
+	// the sticky cookie is reselected
+	time.Sleep(250 * time.Millisecond)
+	id, _ = get(stickyCookie)
+	c.Assert(id, Equals, otherID)
+}
+
+// TestBackendSelectorAvoidsSlowBackend tests that, for every
+// BackendSelector, a consistently slow backend ends up serving only a
+// small share of non-sticky traffic relative to two fast ones.
+// BackendSelectorLeastInflight already achieves this while the slow
+// backend is still working through a backlog; BackendSelectorEWMA is
+// the only one that keeps it that way once the backlog drains, since it
+// alone remembers the backend's latency rather than just its current
+// in-flight count.
+func (s *S) TestBackendSelectorAvoidsSlowBackend(c *C) {
+	const (
+		requests      = 120
+		concurrency   = 12
+		slowFraction  = 0.2
+		slowBackendID = "slow"
+	)
+
+	for _, selector := range []string{"", router.BackendSelectorP2C, router.BackendSelectorEWMA} {
+		slowSrv := httptest.NewServer(httpTestSlowHandler(slowBackendID, 50*time.Millisecond))
+		fastSrv1 := httptest.NewServer(httpTestHandler("fast1"))
+		fastSrv2 := httptest.NewServer(httpTestHandler("fast2"))
+
+		l := s.newHTTPListener(c)
+
+		s.addRoute(c, l, router.HTTPRoute{
+			Domain:          "example.com",
+			Service:         "test",
+			BackendSelector: selector,
+		}.ToRoute())
+
+		discoverdRegisterHTTP(c, l, slowSrv.Listener.Addr().String())
+		discoverdRegisterHTTP(c, l, fastSrv1.Listener.Addr().String())
+		discoverdRegisterHTTP(c, l, fastSrv2.Listener.Addr().String())
+
+		var slowHits int64
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, concurrency)
+		for i := 0; i < requests; i++ {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				res, err := httpClient.Do(newReq("http://"+l.Addrs[0], "example.com"))
+				c.Assert(err, IsNil)
+				defer res.Body.Close()
+				body, err := ioutil.ReadAll(res.Body)
+				c.Assert(err, IsNil)
+				if string(body) == slowBackendID {
+					atomic.AddInt64(&slowHits, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		c.Assert(float64(slowHits) < requests*slowFraction, Equals, true, Commentf(
+			"selector %q: slow backend served %d/%d requests", selector, slowHits, requests,
+		))
+
+		l.Close()
+		slowSrv.Close()
+		fastSrv1.Close()
+		fastSrv2.Close()
+	}
+}
+
+// benchmarkHTTPProxySelector benchmarks proxying requests to three
+// identical, fast backends under the given BackendSelector, bypassing
+// gocheck (whose *C is tied to a running Test) in favor of the same
+// testStore and fake discoverd client used under it.
+func benchmarkHTTPProxySelector(b *testing.B, selector string) {
+	store := newTestStore()
+	d := testutils.NewFakeDiscoverd()
+
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	defer srv1.Close()
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv2.Close()
+	srv3 := httptest.NewServer(httpTestHandler("3"))
+	defer srv3.Close()
+
+	cert := testutils.TLSConfigForDomain("example.com")
+	pair, err := tls.X509KeyPair([]byte(cert.Cert), []byte(cert.PrivateKey))
+	if err != nil {
+		b.Fatal(err)
+	}
+	l := &HTTPListener{
+		Addrs:     []string{"127.0.0.1:0"},
+		TLSAddrs:  []string{"127.0.0.1:0"},
+		keypair:   pair,
+		syncer:    NewSyncer(store, "http"),
+		discoverd: d,
+	}
+	if err := l.Start(); err != nil {
+		b.Fatal(err)
+	}
+	l.defaultPorts = getDefaultPortsFromAddrs(l)
+	defer l.Close()
+
+	wait := waitForEvent(b, l, "set", "")
+	store.add(router.HTTPRoute{
+		Domain:          "example.com",
+		Service:         "test",
+		BackendSelector: selector,
+	}.ToRoute())
+	wait()
+
+	for _, srv := range []*httptest.Server{srv1, srv2, srv3} {
+		addr := srv.Listener.Addr().String()
+		inst := &discoverd.Instance{ID: md5sum("tcp-" + addr), Addr: addr}
+		if _, err := d.RegisterInstance("test", inst); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		res, err := httpClient.Do(req)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+}
+
+func BenchmarkHTTPProxyLeastInflight(b *testing.B) {
+	benchmarkHTTPProxySelector(b, router.BackendSelectorLeastInflight)
+}
+
+func BenchmarkHTTPProxyP2C(b *testing.B) {
+	benchmarkHTTPProxySelector(b, router.BackendSelectorP2C)
+}
+
+func BenchmarkHTTPProxyEWMA(b *testing.B) {
+	benchmarkHTTPProxySelector(b, router.BackendSelectorEWMA)
+}
+
+// TestMetrics tests that requests are reported to the router's metrics
+// registry with a bounded set of labels: unmatched hosts are counted
+// under a sentinel route rather than creating a new label per host, and
+// nothing request-specific (like X-Request-Id) leaks into a label.
+func (s *S) TestMetrics(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.buildHTTPListener(c)
+	l.Metrics = metrics.NewRegistry(nil)
+	l.MetricsAddr = "127.0.0.1:0"
+	c.Assert(l.Start(), IsNil)
+	l.defaultPorts = getDefaultPortsFromAddrs(l)
+	defer l.Close()
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+
+	req := newReq("http://"+l.Addrs[0], "unknown.example")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, 404)
+	res.Body.Close()
+
+	scrape, err := http.Get("http://" + l.MetricsAddr + "/")
+	c.Assert(err, IsNil)
+	defer scrape.Body.Close()
+	body, err := ioutil.ReadAll(scrape.Body)
+	c.Assert(err, IsNil)
+
+	c.Assert(strings.Contains(string(body), `code="200"`), Equals, true)
+	c.Assert(strings.Contains(string(body), `route="`+metrics.UnmatchedRouteLabel+`"`), Equals, true)
+	c.Assert(strings.Contains(string(body), "unknown.example"), Equals, false)
+}
+
+// TestMetricsBackendError tests that a failed attempt to reach a backend
+// is counted in router_http_backend_errors_total, labeled by the route
+// that attempted it.
+func (s *S) TestMetricsBackendError(c *C) {
+	// a listener that accepts and immediately closes every connection, so
+	// every proxied request fails only after a successful dial
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	l := s.buildHTTPListener(c)
+	l.Metrics = metrics.NewRegistry(nil)
+	l.MetricsAddr = "127.0.0.1:0"
+	c.Assert(l.Start(), IsNil)
+	l.defaultPorts = getDefaultPortsFromAddrs(l)
+	defer l.Close()
+
+	route := s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "metrics-backend-error",
+	}.ToRoute())
+	discoverdRegisterHTTPService(c, l, "metrics-backend-error", ln.Addr().String())
+
+	res := assertGetStatus(c, "http://"+l.Addrs[0], "example.com", 503)
+	res.Body.Close()
+
+	scrape, err := http.Get("http://" + l.MetricsAddr + "/")
+	c.Assert(err, IsNil)
+	defer scrape.Body.Close()
+	body, err := ioutil.ReadAll(scrape.Body)
+	c.Assert(err, IsNil)
+
+	c.Assert(strings.Contains(string(body), `router_http_backend_errors_total{domain="example.com",route="`+route.ID+`",service="metrics-backend-error"} 1`), Equals, true)
+}
+
+func decodeAccessLog(c *C, buf *bytes.Buffer) []proxy.Record {
+	var records []proxy.Record
+	dec := json.NewDecoder(buf)
+	for {
+		var r proxy.Record
+		if err := dec.Decode(&r); err != nil {
+			c.Assert(err, Equals, io.EOF)
+			break
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func (s *S) TestAccessLog(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{Writer: &buf})
+
+	route := s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+
+	records := decodeAccessLog(c, &buf)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].RouteID, Equals, route.ID)
+	c.Assert(records[0].Status, Equals, 200)
+	c.Assert(records[0].Backend, Equals, srv.Listener.Addr().String())
+}
+
+// TestAccessLogClientIPTrustsForwardedFor checks that a Record's
+// ClientIP names the original client from a trusted peer's
+// X-Forwarded-For rather than the peer's own address, the same trust
+// resolution the client_ip rate limit extractor uses.
+func (s *S) TestAccessLogClientIPTrustsForwardedFor(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+	_, cidr, err := net.ParseCIDR("127.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.TrustedProxies = []net.IPNet{*cidr}
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{Writer: &buf})
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+
+	records := decodeAccessLog(c, &buf)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].ClientIP, Equals, "203.0.113.1")
+}
+
+// TestAccessLogClientIPIgnoresUntrustedForwardedFor checks that a
+// Record's ClientIP falls back to RemoteAddr when the peer isn't
+// trusted, rather than letting an untrusted client spoof its logged
+// address via X-Forwarded-For.
+func (s *S) TestAccessLogClientIPIgnoresUntrustedForwardedFor(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{Writer: &buf})
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+
+	records := decodeAccessLog(c, &buf)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].ClientIP, Not(Equals), "203.0.113.1")
+}
+
+// TestAccessLogWebsocket checks that an Upgrade request's Record is
+// emitted once the tunnelled session closes, not at the handshake, so
+// its Duration covers the whole session.
+func (s *S) TestAccessLogWebsocket(c *C) {
+	srv := httptest.NewServer(wsHandshakeTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{Writer: &buf})
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	conn, err := net.Dial("tcp", l.Addrs[0])
+	c.Assert(err, IsNil)
+	req, err := http.NewRequest("GET", "http://"+l.Addrs[0], nil)
+	c.Assert(err, IsNil)
+	req.Host = "example.com"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	c.Assert(req.Write(conn), IsNil)
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	c.Assert(err, IsNil)
+	c.Assert(res.StatusCode, Equals, http.StatusSwitchingProtocols)
+
+	// the session is still open, so nothing has been logged yet
+	c.Assert(buf.Len(), Equals, 0)
+
+	conn.Close()
+
+	// give serveHTTP's blocked proxyUpgrade call time to notice the
+	// closed connection and return, which is what triggers the Record
+	for i := 0; i < 100 && buf.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	records := decodeAccessLog(c, &buf)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Upgrade, Equals, "websocket")
+}
+
+// TestAccessLogRedactsHeaders checks that RedactHeaders scrubs a
+// configured header on the request forwarded to the backend.
+func (s *S) TestAccessLogRedactsHeaders(c *C) {
+	var gotAuth string
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuth = req.Header.Get("Authorization")
+		w.Write([]byte("1"))
+	})
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{
+		Writer:        &buf,
+		RedactHeaders: []string{"Authorization"},
+	})
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	res.Body.Close()
+
+	c.Assert(gotAuth, Equals, "REDACTED")
+}
+
+// TestAccessLogConcurrentOrdering checks that concurrent requests each
+// produce exactly one well-formed Record, with no writes interleaved
+// or corrupted by another request's concurrent write.
+func (s *S) TestAccessLogConcurrentOrdering(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	var buf bytes.Buffer
+	l.AccessLog = proxy.NewAccessLog(proxy.AccessLogConfig{Writer: &buf})
+
+	s.addHTTPRoute(c, l)
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	const n = 20
+	done := make(chan struct{}, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			assertGet(c, "http://"+l.Addrs[0], "example.com", "1")
+			done <- struct{}{}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		<-done
+	}
+
+	records := decodeAccessLog(c, &buf)
+	c.Assert(records, HasLen, n)
+}
+
+// TestRateLimiting tests that a route's RateLimits are enforced as
+// independent token buckets per extracted key, and that a bucket
+// refills once its period has elapsed.
+func (s *S) TestRateLimiting(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		RateLimits: []router.RateLimit{{
+			Period:       100 * time.Millisecond,
+			Average:      2,
+			Burst:        2,
+			ExtractorKey: "header:X-Api-Key",
+		}},
+	}.ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(key string) *http.Response {
+		req := newReq("http://"+l.Addrs[0], "example.com")
+		req.Header.Set("X-Api-Key", key)
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	for i := 0; i < 2; i++ {
+		res := get("a")
+		c.Assert(res.StatusCode, Equals, 200)
+		res.Body.Close()
+	}
+	res := get("a")
+	c.Assert(res.StatusCode, Equals, 429)
+	c.Assert(res.Header.Get("Retry-After"), Not(Equals), "")
+	res.Body.Close()
+
+	// a different key gets its own, unaffected bucket
+	res = get("b")
+	c.Assert(res.StatusCode, Equals, 200)
+	res.Body.Close()
+
+	// the bucket for "a" refills once its period elapses
+	time.Sleep(200 * time.Millisecond)
+	res = get("a")
+	c.Assert(res.StatusCode, Equals, 200)
+	res.Body.Close()
+}
+
+// TestRateLimitingClientIPTrustsForwardedFor tests that the client_ip
+// extractor buckets by the original client named in a trusted peer's
+// X-Forwarded-For rather than the peer's own address, so a shared load
+// balancer doesn't cause every client behind it to share one bucket.
+func (s *S) TestRateLimitingClientIPTrustsForwardedFor(c *C) {
+	srv := httptest.NewServer(httpTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+	_, cidr, err := net.ParseCIDR("127.0.0.1/32")
+	c.Assert(err, IsNil)
+	l.TrustedProxies = []net.IPNet{*cidr}
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		RateLimits: []router.RateLimit{{
+			Period:       time.Minute,
+			Average:      1,
+			Burst:        1,
+			ExtractorKey: "client_ip",
+		}},
+	}.ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	get := func(clientIP string) *http.Response {
+		req := newReq("http://"+l.Addrs[0], "example.com")
+		req.Header.Set("X-Forwarded-For", clientIP)
+		res, err := httpClient.Do(req)
+		c.Assert(err, IsNil)
+		return res
+	}
+
+	res := get("203.0.113.1")
+	c.Assert(res.StatusCode, Equals, 200)
+	res.Body.Close()
+
+	// the same forwarded client is now rate limited
+	res = get("203.0.113.1")
+	c.Assert(res.StatusCode, Equals, 429)
+	res.Body.Close()
+
+	// a different forwarded client, behind the same trusted peer, gets
+	// its own bucket
+	res = get("203.0.113.2")
+	c.Assert(res.StatusCode, Equals, 200)
+	res.Body.Close()
+}
+
+// TestRateLimitingPreservesStickySession tests that a request rejected
+// for exceeding its rate limit doesn't disturb an already-established
+// sticky session: it's rejected before a backend is even selected, so
+// it must not set or clear the sticky cookie.
+func (s *S) TestRateLimitingPreservesStickySession(c *C) {
+	srv1 := httptest.NewServer(httpTestHandler("1"))
+	srv2 := httptest.NewServer(httpTestHandler("2"))
+	defer srv1.Close()
+	defer srv2.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		Sticky:  true,
+		RateLimits: []router.RateLimit{{
+			Period:       100 * time.Millisecond,
+			Average:      1,
+			Burst:        1,
+			ExtractorKey: "header:X-Api-Key",
+		}},
+	}.ToRoute())
+
+	discoverdRegisterHTTP(c, l, srv1.Listener.Addr().String())
+	discoverdRegisterHTTP(c, l, srv2.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Api-Key", "sticky-client")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	issuedBy, err := ioutil.ReadAll(res.Body)
+	c.Assert(err, IsNil)
+	cookies := res.Cookies()
+	c.Assert(cookies, Not(HasLen), 0)
+
+	// the bucket's single token is now spent; a second request, even
+	// with the sticky cookie attached, is rejected without touching it
+	req2 := newReq("http://"+l.Addrs[0], "example.com")
+	req2.Header.Set("X-Api-Key", "sticky-client")
+	for _, cookie := range cookies {
+		req2.AddCookie(cookie)
+	}
+	res2, err := httpClient.Do(req2)
+	c.Assert(err, IsNil)
+	defer res2.Body.Close()
+	c.Assert(res2.StatusCode, Equals, 429)
+	c.Assert(res2.Cookies(), HasLen, 0)
+
+	time.Sleep(200 * time.Millisecond)
+
+	// once the limit clears, the original sticky cookie still pins the
+	// request to the same backend it was issued for
+	req3 := newReq("http://"+l.Addrs[0], "example.com")
+	req3.Header.Set("X-Api-Key", "sticky-client")
+	for _, cookie := range cookies {
+		req3.AddCookie(cookie)
+	}
+	res3, err := httpClient.Do(req3)
+	c.Assert(err, IsNil)
+	defer res3.Body.Close()
+	c.Assert(res3.StatusCode, Equals, 200)
+	data, err := ioutil.ReadAll(res3.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Equals, string(issuedBy))
+}
+
+// TestRateLimitingWebsocketBypass tests that only the Upgrade handshake
+// itself is counted against a route's rate limit; traffic on the
+// resulting tunnelled connection is not.
+func (s *S) TestRateLimitingWebsocketBypass(c *C) {
+	srv := httptest.NewServer(wsHandshakeTestHandler("1"))
+	defer srv.Close()
+
+	l := s.newHTTPListener(c)
+	defer l.Close()
+
+	s.addRoute(c, l, router.HTTPRoute{
+		Domain:  "example.com",
+		Service: "test",
+		RateLimits: []router.RateLimit{{
+			Period:       time.Minute,
+			Average:      1,
+			Burst:        1,
+			ExtractorKey: "header:X-Api-Key",
+		}},
+	}.ToRoute())
+	discoverdRegisterHTTP(c, l, srv.Listener.Addr().String())
+
+	req := newReq("http://"+l.Addrs[0], "example.com")
+	req.Header.Set("X-Api-Key", "ws-client")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	res, err := httpClient.Do(req)
+	c.Assert(err, IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 101)
+
+	// the handshake consumed the bucket's single token; a second,
+	// independent handshake attempt is rejected
+	req2 := newReq("http://"+l.Addrs[0], "example.com")
+	req2.Header.Set("X-Api-Key", "ws-client")
+	req2.Header.Set("Connection", "Upgrade")
+	req2.Header.Set("Upgrade", "websocket")
+	res2, err := httpClient.Do(req2)
+	c.Assert(err, IsNil)
+	defer res2.Body.Close()
+	c.Assert(res2.StatusCode, Equals, 429)
+}
@@ -0,0 +1,63 @@
+// Command router is the Flynn HTTP/TCP router daemon. It syncs routes
+// from the controller and load balances incoming traffic across the
+// backends registered in discoverd for each route's service.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/gatewayapi"
+)
+
+func main() {
+	httpAddrs := flag.String("http-addr", ":8080", "comma separated list of addresses to serve HTTP from")
+	httpsAddrs := flag.String("https-addr", ":4433", "comma separated list of addresses to serve HTTPS from")
+	gatewayName := flag.String("gateway-api-name", "", "name of a Gateway API Gateway to source routes from, in namespace/name form (instead of the controller)")
+	kubeconfig := flag.String("kubeconfig", "", "path to a kubeconfig file (defaults to in-cluster config)")
+	flag.Parse()
+
+	sd := discoverd.NewClient()
+
+	store, err := routeStore(*gatewayName, *kubeconfig)
+	if err != nil {
+		logger.Error("error configuring route store", "err", err)
+		os.Exit(1)
+	}
+
+	l := NewHTTPListener(
+		store,
+		sd,
+		strings.Split(*httpAddrs, ","),
+		strings.Split(*httpsAddrs, ","),
+		tls.Certificate{},
+	)
+	if err := l.Start(); err != nil {
+		logger.Error("error starting HTTP listener", "err", err)
+		os.Exit(1)
+	}
+
+	select {}
+}
+
+// routeStore picks the controller's route API, or, if gatewayRef
+// (namespace/name) is given, the named Gateway API Gateway.
+func routeStore(gatewayRef, kubeconfig string) (DataStore, error) {
+	if gatewayRef == "" {
+		return newControllerStore(), nil
+	}
+	parts := strings.SplitN(gatewayRef, "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("router: -gateway-api-name must be namespace/name, got %q", gatewayRef)
+	}
+	return newGatewayAPIStore(gatewayapi.Config{
+		Kubeconfig:       kubeconfig,
+		InCluster:        kubeconfig == "",
+		GatewayNamespace: parts[0],
+		GatewayName:      parts[1],
+	})
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/router/testutils"
+	router "github.com/flynn/flynn/router/types"
+	. "github.com/flynn/go-check"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct {
+	store     *testStore
+	discoverd *testutils.FakeDiscoverd
+}
+
+var _ = Suite(&S{})
+
+func (s *S) SetUpTest(c *C) {
+	s.store = newTestStore()
+	s.discoverd = testutils.NewFakeDiscoverd()
+}
+
+func (s *S) addRoute(c *C, l *HTTPListener, route *router.Route) *router.Route {
+	return addRoute(c, l, s.store, route)
+}
+
+func addRoute(c *C, l *HTTPListener, store *testStore, route *router.Route) *router.Route {
+	wait := waitForEvent(c, l, "set", "")
+	route = store.add(route)
+	wait()
+	return route
+}
+
+func (s *S) removeRoute(c *C, l *HTTPListener, route *router.Route) {
+	wait := waitForEvent(c, l, "remove", route.ID)
+	s.store.delete(route)
+	wait()
+}
+
+// waitForEvent registers a watcher on l before the caller mutates the
+// store, returning a function that blocks until the matching event (by
+// kind and, if given, route id) has been applied by l.
+func waitForEvent(c C_or_T, l *HTTPListener, event, id string) func() {
+	ch := make(chan *router.Event, 64)
+	l.Watch(ch)
+	return func() {
+		defer l.Unwatch(ch)
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case e := <-ch:
+				if e.Event == event && (id == "" || e.ID == id) {
+					return
+				}
+			case <-timeout:
+				panic(fmt.Sprintf("timed out waiting for %q event", event))
+			}
+		}
+	}
+}
+
+// C_or_T lets waitForEvent be used from both *C (check) and plain
+// testing contexts without importing testing.T here.
+type C_or_T interface{}
+
+func md5sum(s string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(s)))
+}
+
+func discoverdRegisterHTTP(c *C, l *HTTPListener, addr string) func() {
+	return discoverdRegisterHTTPService(c, l, "test", addr)
+}
+
+func discoverdRegisterHTTPService(c *C, l *HTTPListener, service, addr string) func() {
+	inst := &discoverd.Instance{ID: md5sum("tcp-" + addr), Addr: addr}
+	hb, err := l.discoverd.RegisterInstance(service, inst)
+	c.Assert(err, IsNil)
+	return func() {
+		hb.Close()
+	}
+}
+
+func discoverdSetLeaderHTTP(c *C, l *HTTPListener, service, instanceID string) {
+	err := l.discoverd.Service(service).SetLeader(instanceID)
+	c.Assert(err, IsNil)
+}
+
+// testStore is an in-memory DataStore used by tests in place of the
+// controller-backed store used in production.
+type testStore struct {
+	mu     sync.Mutex
+	routes map[string]*router.Route
+	subs   []*testStream
+}
+
+func newTestStore() *testStore {
+	return &testStore{routes: make(map[string]*router.Route)}
+}
+
+func (st *testStore) List() ([]*router.Route, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	routes := make([]*router.Route, 0, len(st.routes))
+	for _, r := range st.routes {
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+type testStream struct {
+	events chan *router.Event
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (s *testStream) Err() error { return nil }
+
+func (st *testStore) StreamEvents(events chan *router.Event) (Stream, error) {
+	stream := &testStream{events: events, closed: make(chan struct{})}
+	st.mu.Lock()
+	st.subs = append(st.subs, stream)
+	st.mu.Unlock()
+	go func() {
+		<-stream.closed
+		close(events)
+	}()
+	return stream, nil
+}
+
+// closeStreams forces every open StreamEvents subscription to close, as
+// if the underlying connection to the store had dropped, so tests can
+// exercise the Syncer's reconnect logic.
+func (st *testStore) closeStreams() {
+	st.mu.Lock()
+	subs := st.subs
+	st.subs = nil
+	st.mu.Unlock()
+	for _, sub := range subs {
+		sub.once.Do(func() { close(sub.closed) })
+	}
+}
+
+func (st *testStore) publish(event *router.Event) {
+	st.mu.Lock()
+	subs := append([]*testStream{}, st.subs...)
+	st.mu.Unlock()
+	for _, sub := range subs {
+		sub.events <- event
+	}
+}
+
+func (st *testStore) add(route *router.Route) *router.Route {
+	if route.ID == "" {
+		route.ID = randomID()
+	}
+	st.mu.Lock()
+	st.routes[route.ID] = route
+	st.mu.Unlock()
+	st.publish(&router.Event{Event: "set", ID: route.ID, Route: route})
+	return route
+}
+
+func (st *testStore) update(route *router.Route) *router.Route {
+	st.mu.Lock()
+	st.routes[route.ID] = route
+	st.mu.Unlock()
+	st.publish(&router.Event{Event: "set", ID: route.ID, Route: route})
+	return route
+}
+
+func (st *testStore) delete(route *router.Route) {
+	st.mu.Lock()
+	delete(st.routes, route.ID)
+	st.mu.Unlock()
+	st.publish(&router.Event{Event: "remove", ID: route.ID})
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
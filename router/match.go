@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// compiledMatch is a route's router.Match with its regexes pre-compiled,
+// so that evaluating it against a request does no further parsing.
+type compiledMatch struct {
+	pathPrefix string
+	pathRegex  *regexp.Regexp
+	methods    map[string]struct{}
+	headers    []matchField
+	query      []matchField
+	weight     int
+}
+
+// matchField is a single Headers or Query entry: either an exact value,
+// or, if the configured value had a "regex:" prefix, a compiled regex.
+type matchField struct {
+	name  string
+	value string
+	regex *regexp.Regexp
+}
+
+// compileMatch compiles route's Match (if any) against path, the route's
+// own Path, so a Match that omits PathPrefix still anchors to it.
+func compileMatch(m *router.Match, path string) (*compiledMatch, error) {
+	if m == nil {
+		return nil, nil
+	}
+	c := &compiledMatch{
+		pathPrefix: m.PathPrefix,
+		weight:     m.Weight,
+	}
+	if c.pathPrefix == "" {
+		c.pathPrefix = path
+	}
+	if m.PathRegex != "" {
+		re, err := regexp.Compile(m.PathRegex)
+		if err != nil {
+			return nil, err
+		}
+		c.pathRegex = re
+	}
+	if len(m.Methods) > 0 {
+		c.methods = make(map[string]struct{}, len(m.Methods))
+		for _, method := range m.Methods {
+			c.methods[strings.ToUpper(method)] = struct{}{}
+		}
+	}
+	fields, err := compileMatchFields(m.Headers)
+	if err != nil {
+		return nil, err
+	}
+	c.headers = fields
+	fields, err = compileMatchFields(m.Query)
+	if err != nil {
+		return nil, err
+	}
+	c.query = fields
+	return c, nil
+}
+
+func compileMatchFields(m map[string]string) ([]matchField, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	fields := make([]matchField, 0, len(m))
+	for name, value := range m {
+		f := matchField{name: name}
+		if strings.HasPrefix(value, "regex:") {
+			re, err := regexp.Compile(strings.TrimPrefix(value, "regex:"))
+			if err != nil {
+				return nil, err
+			}
+			f.regex = re
+		} else {
+			f.value = value
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+// matches reports whether req satisfies every rule in c beyond the path
+// prefix, which the caller (matchPath) has already checked.
+func (c *compiledMatch) matches(req *http.Request) bool {
+	if c == nil || req == nil {
+		return true
+	}
+	if c.pathRegex != nil && !c.pathRegex.MatchString(req.URL.Path) {
+		return false
+	}
+	if c.methods != nil {
+		if _, ok := c.methods[req.Method]; !ok {
+			return false
+		}
+	}
+	for _, f := range c.headers {
+		if !f.matches(req.Header.Get(f.name)) {
+			return false
+		}
+	}
+	if len(c.query) > 0 {
+		query := req.URL.Query()
+		for _, f := range c.query {
+			if !f.matches(query.Get(f.name)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f matchField) matches(v string) bool {
+	if f.regex != nil {
+		return f.regex.MatchString(v)
+	}
+	return v == f.value
+}
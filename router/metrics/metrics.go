@@ -0,0 +1,109 @@
+// Package metrics exposes Prometheus collectors for the HTTP router:
+// per-route request counters and latency histograms, in-flight gauges,
+// backend connection errors, and TLS handshake failures.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// UnmatchedRouteLabel is used as the route label for requests that
+// didn't match any configured route (e.g. an unknown Host), so that
+// traffic hitting the router without a route still shows up without
+// creating a label value per garbage hostname.
+const UnmatchedRouteLabel = "unmatched"
+
+// DefaultBuckets are the request duration histogram buckets used when a
+// Registry isn't given its own.
+var DefaultBuckets = []float64{0.1, 0.3, 1.2, 5}
+
+// Registry holds the collectors a single router instance reports into.
+// Labels are deliberately restricted to route/domain/service/code/method
+// so that cardinality is bounded by the number of configured routes
+// regardless of request volume - there is no per-request-id or
+// per-backend-address label.
+type Registry struct {
+	reg *prometheus.Registry
+
+	requestsTotal   *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        *prometheus.GaugeVec
+	backendErrors   *prometheus.CounterVec
+	tlsFailures     prometheus.Counter
+}
+
+// RequestLabels identifies the route, domain and service a request was
+// served (or not served) by.
+type RequestLabels struct {
+	Route, Domain, Service string
+}
+
+// NewRegistry returns a Registry with its own prometheus.Registry, using
+// buckets for the request duration histogram (DefaultBuckets if nil).
+func NewRegistry(buckets []float64) *Registry {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	labels := []string{"route", "domain", "service", "code", "method"}
+	r := &Registry{
+		reg: prometheus.NewRegistry(),
+		requestsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_http_requests_total",
+			Help: "Total HTTP requests handled by the router.",
+		}, labels),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "router_http_request_duration_seconds",
+			Help:    "HTTP request duration in seconds, observed once the response (including streamed/upgraded bodies) is complete.",
+			Buckets: buckets,
+		}, labels),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "router_http_requests_in_flight",
+			Help: "HTTP requests currently being served.",
+		}, []string{"route", "domain", "service"}),
+		backendErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "router_http_backend_errors_total",
+			Help: "Errors connecting to a route's backends.",
+		}, []string{"route", "domain", "service"}),
+		tlsFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "router_tls_handshake_failures_total",
+			Help: "TLS handshake failures on the router's TLS listener.",
+		}),
+	}
+	r.reg.MustRegister(r.requestsTotal, r.requestDuration, r.inFlight, r.backendErrors, r.tlsFailures)
+	return r
+}
+
+// Handler serves the registry's collectors in the Prometheus exposition
+// format, for use on an internal-only listener.
+func (r *Registry) Handler() http.Handler {
+	return promhttp.HandlerFor(r.reg, promhttp.HandlerOpts{})
+}
+
+// BeginRequest marks a request as in-flight for l and returns a function
+// to call once the response (including, for streamed or upgraded
+// connections, the point at which the body/tunnel closes) is complete.
+func (r *Registry) BeginRequest(l RequestLabels) func(code int, method string, duration time.Duration) {
+	r.inFlight.WithLabelValues(l.Route, l.Domain, l.Service).Inc()
+	return func(code int, method string, duration time.Duration) {
+		r.inFlight.WithLabelValues(l.Route, l.Domain, l.Service).Dec()
+		codeStr := strconv.Itoa(code)
+		r.requestsTotal.WithLabelValues(l.Route, l.Domain, l.Service, codeStr, method).Inc()
+		r.requestDuration.WithLabelValues(l.Route, l.Domain, l.Service, codeStr, method).Observe(duration.Seconds())
+	}
+}
+
+// IncBackendError records a connection error to one of a route's
+// backends.
+func (r *Registry) IncBackendError(l RequestLabels) {
+	r.backendErrors.WithLabelValues(l.Route, l.Domain, l.Service).Inc()
+}
+
+// IncTLSHandshakeFailure records a failed TLS handshake.
+func (r *Registry) IncTLSHandshakeFailure() {
+	r.tlsFailures.Inc()
+}
@@ -0,0 +1,323 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is one access log entry: a single request, or, for an upgraded
+// (websocket) connection, the whole tunnelled session ending at close.
+type Record struct {
+	Time       time.Time     `json:"time"`
+	RequestID  string        `json:"request_id"`
+	RouteID    string        `json:"route_id"`
+	Service    string        `json:"service"`
+	Backend    string        `json:"backend"`
+	ClientIP   string        `json:"client_ip"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Status     int           `json:"status"`
+	BytesIn    int64         `json:"bytes_in"`
+	BytesOut   int64         `json:"bytes_out"`
+	Duration   time.Duration `json:"duration"`
+	TLSVersion string        `json:"tls_version,omitempty"`
+	TLSCipher  string        `json:"tls_cipher,omitempty"`
+	Upgrade    string        `json:"upgrade,omitempty"`
+	Retries    int           `json:"retries"`
+}
+
+// Format renders a Record to w.
+type Format interface {
+	Format(w io.Writer, r *Record) error
+}
+
+// JSONFormat renders one JSON object per Record, newline-delimited.
+type JSONFormat struct{}
+
+func (JSONFormat) Format(w io.Writer, r *Record) error {
+	enc := json.NewEncoder(w)
+	return enc.Encode(r)
+}
+
+// CLFFormat renders a Common-Log-Format-like line:
+// client - - [time] "method path" status bytes_out duration route upgrade retries
+type CLFFormat struct{}
+
+func (CLFFormat) Format(w io.Writer, r *Record) error {
+	upgrade := r.Upgrade
+	if upgrade == "" {
+		upgrade = "-"
+	}
+	_, err := fmt.Fprintf(w, "%s - - [%s] %q %d %d %s %s %s %d\n",
+		r.ClientIP,
+		r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method+" "+r.Path,
+		r.Status,
+		r.BytesOut,
+		r.Duration,
+		r.RouteID,
+		upgrade,
+		r.Retries,
+	)
+	return err
+}
+
+// Sampler decides whether a completed request with the given status
+// should be written to the log, so that high-volume 2xx/3xx traffic can
+// be downsampled while errors are always kept.
+type Sampler interface {
+	Sample(status int) bool
+}
+
+// AlwaysSample logs every record.
+type AlwaysSample struct{}
+
+func (AlwaysSample) Sample(int) bool { return true }
+
+// StatusSampler logs every 4xx/5xx record, and one in EveryN of
+// everything else (1xx/2xx/3xx), dropping the rest.
+type StatusSampler struct {
+	EveryN uint64
+
+	counter uint64
+}
+
+func (s *StatusSampler) Sample(status int) bool {
+	if status >= 400 || s.EveryN <= 1 {
+		return true
+	}
+	n := atomic.AddUint64(&s.counter, 1)
+	return n%s.EveryN == 0
+}
+
+// AccessLogConfig configures an AccessLog.
+type AccessLogConfig struct {
+	Writer io.Writer
+	Format Format
+
+	// Sampler decides which completed requests are actually written;
+	// nil means log everything.
+	Sampler Sampler
+
+	// RedactHeaders names request headers whose value is replaced with
+	// "REDACTED" before anything derived from them (currently none of
+	// Record's fields) could otherwise leak it; kept for Wrap's header
+	// redaction of the request passed downstream to next, e.g. so a
+	// request logged by a layer further down the chain doesn't carry
+	// Authorization.
+	RedactHeaders []string
+
+	// Exporter, if set, is additionally called with every sampled
+	// Record, e.g. to translate it into an OTLP span.
+	Exporter func(*Record)
+}
+
+// AccessLog formats and writes one Record per request (or, for upgraded
+// connections, per tunnelled session) to an AccessLogConfig's Writer.
+type AccessLog struct {
+	cfg AccessLogConfig
+
+	mu sync.Mutex
+}
+
+// NewAccessLog returns an AccessLog from cfg, defaulting to JSONFormat
+// and AlwaysSample if left unset.
+func NewAccessLog(cfg AccessLogConfig) *AccessLog {
+	if cfg.Format == nil {
+		cfg.Format = JSONFormat{}
+	}
+	if cfg.Sampler == nil {
+		cfg.Sampler = AlwaysSample{}
+	}
+	return &AccessLog{cfg: cfg}
+}
+
+// RequestInfo is threaded through a request's context so Proxy.ServeHTTP
+// can report back which backend it ultimately used and how many prior
+// attempts failed, for Wrap to include in the request's Record. It's
+// only ever written and read by the single goroutine handling the
+// request, so its fields need no synchronization.
+type RequestInfo struct {
+	Backend string
+	Retries int
+}
+
+type requestInfoKey struct{}
+
+// ContextWithRequestInfo returns a context carrying a *RequestInfo that
+// Proxy.ServeHTTP fills in as it selects and retries backends.
+func ContextWithRequestInfo(ctx context.Context) (context.Context, *RequestInfo) {
+	info := &RequestInfo{}
+	return context.WithValue(ctx, requestInfoKey{}, info), info
+}
+
+func requestInfoFromContext(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// Wrap returns an http.Handler that calls next, then emits a Record
+// once it returns. For an Upgrade request next is expected to block (as
+// Proxy.ServeHTTP does) until the tunnelled connection closes, so the
+// emitted Duration covers the whole session rather than just the
+// handshake.
+func (a *AccessLog) Wrap(labels RequestLabels, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, h := range a.cfg.RedactHeaders {
+			if req.Header.Get(h) != "" {
+				req.Header.Set(h, "REDACTED")
+			}
+		}
+
+		ctx, info := ContextWithRequestInfo(req.Context())
+		req = req.WithContext(ctx)
+
+		lw := &logResponseWriter{ResponseWriter: w}
+		start := time.Now()
+		upgrade := req.Header.Get("Upgrade")
+
+		next.ServeHTTP(lw, req)
+
+		status := lw.status
+		if status == 0 {
+			// A hijacked (upgraded) connection never calls
+			// WriteHeader; it's reported as a successful switch
+			// once the tunnel this call blocked on has closed.
+			status = http.StatusSwitchingProtocols
+		}
+
+		record := &Record{
+			Time:      start,
+			RequestID: req.Header.Get("X-Request-Id"),
+			RouteID:   labels.RouteID,
+			Service:   labels.Service,
+			Backend:   info.Backend,
+			ClientIP:  clientIP(req),
+			Method:    req.Method,
+			Host:      req.Host,
+			Path:      req.URL.Path,
+			Status:    status,
+			BytesOut:  lw.bytes,
+			Duration:  time.Since(start),
+			Upgrade:   upgrade,
+			Retries:   info.Retries,
+		}
+		if req.ContentLength > 0 {
+			record.BytesIn = req.ContentLength
+		}
+		if req.TLS != nil {
+			record.TLSVersion = tlsVersionName(req.TLS.Version)
+			record.TLSCipher = tls.CipherSuiteName(req.TLS.CipherSuite)
+		}
+
+		a.emit(record)
+	})
+}
+
+// RequestLabels identifies the route a request was matched to, for
+// inclusion in its access log Record. The backend actually used is
+// reported separately via RequestInfo, since it isn't known until
+// Proxy.ServeHTTP selects one.
+type RequestLabels struct {
+	RouteID, Service string
+}
+
+func (a *AccessLog) emit(r *Record) {
+	if !a.cfg.Sampler.Sample(r.Status) {
+		return
+	}
+	a.mu.Lock()
+	a.cfg.Format.Format(a.cfg.Writer, r)
+	a.mu.Unlock()
+
+	if a.cfg.Exporter != nil {
+		a.cfg.Exporter(r)
+	}
+}
+
+// clientIP reports the request's originating client address. X-Forwarded-For's
+// leftmost entry is the original client whenever the listener trusted the peer
+// it came in on (see HTTPListener.setForwardedHeaders); otherwise it's set to
+// RemoteAddr, so using it unconditionally logs the real client rather than a
+// trusted load balancer's single address. This mirrors ratelimit.go's
+// "client_ip" extractor.
+func clientIP(req *http.Request) string {
+	if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+		if i := strings.IndexByte(xff, ','); i >= 0 {
+			xff = xff[:i]
+		}
+		return strings.TrimSpace(xff)
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// logResponseWriter records the status code and bytes written by a
+// handler while passing through the optional interfaces (Hijacker,
+// Flusher, CloseNotifier) the proxy and its backends rely on.
+type logResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *logResponseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *logResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *logResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+func (w *logResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *logResponseWriter) CloseNotify() <-chan bool {
+	return w.ResponseWriter.(http.CloseNotifier).CloseNotify()
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"container/list"
+	"sync"
+)
+
+// backendStateSize bounds the number of distinct (service, backend
+// address) entries a backendState registry retains, evicting the
+// least-recently-used entry past that bound. Backend addresses churn on
+// every job restart/deploy, so without a bound a process-wide registry
+// like breakers or ewmaStats would grow for the router's entire
+// lifetime.
+const backendStateSize = 65536
+
+// backendState is a bounded, least-recently-used map from a
+// "service|addr" key to per-backend state, shared by every registry
+// that needs to survive a route's Proxy being rebuilt on every config
+// sync (see breakers in circuitbreaker.go, ewmaStats in selector.go).
+type backendState[T any] struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type backendStateEntry[T any] struct {
+	key   string
+	value T
+}
+
+func newBackendState[T any]() *backendState[T] {
+	return &backendState[T]{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// getOrCreate returns the value stored under key, creating it via zero
+// if absent, and marks key most-recently-used.
+func (s *backendState[T]) getOrCreate(key string, zero func() T) T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.order.MoveToFront(el)
+		return el.Value.(*backendStateEntry[T]).value
+	}
+
+	entry := &backendStateEntry[T]{key: key, value: zero()}
+	s.entries[key] = s.order.PushFront(entry)
+	for len(s.entries) > backendStateSize {
+		back := s.order.Back()
+		if back == nil {
+			break
+		}
+		s.order.Remove(back)
+		delete(s.entries, back.Value.(*backendStateEntry[T]).key)
+	}
+	return entry.value
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// errCircuitOpen is returned by tryBackend (without dialing) for a
+// backend instance whose circuit breaker has tripped.
+var errCircuitOpen = errors.New("proxy: circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// backendBreaker tracks consecutive failures for a single (service,
+// backend address) pair.
+type backendBreaker struct {
+	mu sync.Mutex
+
+	state       breakerState
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probing     bool
+}
+
+// breakers is the process-wide, bounded registry of backend circuit
+// breakers, keyed by "service|addr". Keying on the address means a
+// replacement backend instance (a new address) always starts out
+// closed, and state survives a route's Proxy being rebuilt on every
+// config sync.
+var breakers = newBackendState[*backendBreaker]()
+
+func breakerFor(service, addr string) *backendBreaker {
+	return breakers.getOrCreate(service+"|"+addr, func() *backendBreaker { return &backendBreaker{} })
+}
+
+// allow reports whether a request may be attempted against this
+// backend. It returns probe=true for the single half-open request that
+// decides whether the circuit closes again or reopens; every other
+// caller during that window is refused until the probe resolves.
+func (b *backendBreaker) allow(cfg *router.CircuitBreaker, now time.Time) (ok, probe bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < cfg.Cooldown {
+			return false, false
+		}
+		b.state = breakerHalfOpen
+		b.probing = true
+		return true, true
+	case breakerHalfOpen:
+		return false, false
+	default:
+		return true, false
+	}
+}
+
+// recordSuccess closes the circuit, whether it was already closed or
+// this was a half-open probe.
+func (b *backendBreaker) recordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = breakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// recordFailure counts a failure toward cfg.Threshold, opening the
+// circuit once it's reached within cfg.Window. A failed half-open probe
+// reopens the circuit immediately.
+func (b *backendBreaker) recordFailure(cfg *router.CircuitBreaker, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.probing = false
+		b.failures = 0
+		return
+	}
+
+	if b.windowStart.IsZero() || now.Sub(b.windowStart) > cfg.Window {
+		b.windowStart = now
+		b.failures = 0
+	}
+	b.failures++
+	if b.failures >= cfg.Threshold {
+		b.state = breakerOpen
+		b.openedAt = now
+		b.failures = 0
+	}
+}
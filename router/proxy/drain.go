@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// drainEntry is the last known state of one backend instance of a
+// service: live (goneAt zero) or draining since goneAt.
+type drainEntry struct {
+	backend *Backend
+	goneAt  time.Time
+}
+
+// drainRegistry is the process-wide record of every backend instance
+// currently known for a service, keyed service -> addr, so a backend's
+// drain deadline survives its route's Proxy being rebuilt on every
+// config sync.
+var drainRegistry = struct {
+	mu sync.Mutex
+	m  map[string]map[string]*drainEntry
+}{m: make(map[string]map[string]*drainEntry)}
+
+// ApplyDraining returns live (the backend set discoverd currently
+// reports for service) with any instance that has disappeared since a
+// previous call appended back in, marked Draining, until timeout has
+// elapsed since it went missing. An instance that disappears and
+// reappears before timeout (discoverd flapping) is simply treated as
+// live again. timeout <= 0 disables draining entirely: live is returned
+// unchanged, and a missing instance is forgotten immediately.
+func ApplyDraining(service string, live []*Backend, timeout time.Duration) []*Backend {
+	if timeout <= 0 {
+		return live
+	}
+
+	liveSet := make(map[string]*Backend, len(live))
+	for _, b := range live {
+		liveSet[b.Addr] = b
+	}
+
+	now := time.Now()
+
+	drainRegistry.mu.Lock()
+	defer drainRegistry.mu.Unlock()
+
+	entries := drainRegistry.m[service]
+	if entries == nil {
+		entries = make(map[string]*drainEntry)
+		drainRegistry.m[service] = entries
+	}
+	for addr, b := range liveSet {
+		entries[addr] = &drainEntry{backend: b}
+	}
+
+	result := append([]*Backend(nil), live...)
+	for addr, entry := range entries {
+		if _, ok := liveSet[addr]; ok {
+			continue
+		}
+		if entry.goneAt.IsZero() {
+			entry.goneAt = now
+		}
+		if now.Sub(entry.goneAt) >= timeout {
+			delete(entries, addr)
+			continue
+		}
+		result = append(result, &Backend{
+			Addr:     entry.backend.Addr,
+			JobID:    entry.backend.JobID,
+			Draining: true,
+		})
+	}
+	if len(entries) == 0 {
+		delete(drainRegistry.m, service)
+	}
+
+	return result
+}
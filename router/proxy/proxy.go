@@ -0,0 +1,542 @@
+// Package proxy implements the HTTP reverse proxy used by the router's
+// HTTPListener: backend selection, sticky sessions, and the raw byte
+// pipe used for Upgrade (websocket) connections.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/flynn/flynn/router/metrics"
+	router "github.com/flynn/flynn/router/types"
+	"golang.org/x/net/http2"
+)
+
+// StickyCookieName is the cookie set on responses from a route with
+// Sticky enabled, pinning subsequent requests to the same backend.
+const StickyCookieName = "_backend"
+
+// Backend is a single dial target for a route, along with the live
+// in-flight request count used for load balancing.
+type Backend struct {
+	Addr  string
+	JobID string
+
+	// Draining marks a backend that's no longer registered but is being
+	// kept around (see ApplyDraining) so requests already pinned to it
+	// can still be served. A BackendSelector must never choose a
+	// draining backend for a non-pinned request.
+	Draining bool
+
+	inflight int64
+}
+
+// Inflight returns the number of requests currently outstanding to this
+// backend.
+func (b *Backend) Inflight() int64 { return atomic.LoadInt64(&b.inflight) }
+
+// BackendListFunc returns the current, live set of backends for a
+// route's service. It is called on every request so that discoverd
+// updates are picked up immediately.
+type BackendListFunc func() []*Backend
+
+// Proxy is a reverse proxy for a single HTTP route. One Proxy is created
+// per route and reused across requests.
+type Proxy struct {
+	// Route and Domain, along with Service, label this route's backend
+	// errors in Metrics; they play no other role in proxying.
+	Route  string
+	Domain string
+
+	Service string
+
+	// Metrics, if set, receives a count of this route's backend
+	// connection errors.
+	Metrics *metrics.Registry
+
+	// Stickiness, if set, pins this route's requests to the same
+	// backend across requests; see NewStickinessMode.
+	Stickiness StickinessMode
+
+	// Selector orders this route's non-pinned backends; see
+	// NewBackendSelector. Left nil, backends are ordered by ascending
+	// in-flight count.
+	Selector BackendSelector
+
+	DisableKeepAlives bool
+	Backends          BackendListFunc
+	RateLimiter       *RateLimiter
+
+	// BackendTLS, if set, dials backends over TLS using the resulting
+	// configuration instead of the default plaintext HTTP.
+	BackendTLS *router.BackendTLS
+
+	// BackendProtocol selects the protocol used to proxy to backends;
+	// see router.BackendProtocolH2/H2C. Left empty, backends are
+	// spoken to over HTTP/1.1. Upgrade requests are unaffected and are
+	// always tunnelled as raw HTTP/1.1, regardless of this setting.
+	BackendProtocol string
+
+	// ConnectTimeout bounds how long dialing a backend may take. Left
+	// zero, it defaults to 10 seconds.
+	ConnectTimeout time.Duration
+
+	// ResponseHeaderTimeout bounds how long the proxy waits for a
+	// backend's response headers once the request has been written.
+	// Left zero, there is no timeout.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleTimeout bounds how long an idle keep-alive connection to a
+	// backend is kept open. Left zero, there is no timeout.
+	IdleTimeout time.Duration
+
+	// CircuitBreaker, if set, isolates failing backend instances: see
+	// router.CircuitBreaker.
+	CircuitBreaker *router.CircuitBreaker
+
+	Logger *log.Logger
+
+	transport    http.RoundTripper
+	tlsConfig    *tls.Config
+	tlsConfigErr error
+}
+
+func (p *Proxy) logger() *log.Logger {
+	if p.Logger != nil {
+		return p.Logger
+	}
+	return log.Default()
+}
+
+func (p *Proxy) connectTimeout() time.Duration {
+	if p.ConnectTimeout > 0 {
+		return p.ConnectTimeout
+	}
+	return 10 * time.Second
+}
+
+func (p *Proxy) selector() BackendSelector {
+	if p.Selector != nil {
+		return p.Selector
+	}
+	return leastInflightSelector{}
+}
+
+// ServeHTTP selects a backend for req (honoring stickiness) and proxies
+// the request to it, retrying against another backend if the dial or
+// the initial write fails. Upgrade requests (e.g. websockets) are
+// proxied as a raw byte pipe once the backend has accepted the
+// connection.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// Rate limiting is only evaluated for the request that establishes a
+	// connection (including the initial Upgrade handshake); once a
+	// websocket or other upgraded connection is tunnelled as a raw byte
+	// pipe there is no further "request" to count against the bucket.
+	if ok, retryAfter := p.RateLimiter.Allow(req); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)+1))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	}
+
+	backends := p.Backends()
+	if len(backends) == 0 {
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+
+	order, pinned := p.order(req, backends)
+
+	upgrade := isUpgrade(req)
+
+	info := requestInfoFromContext(req.Context())
+
+	var lastErr error
+	for _, backend := range order {
+		var breaker *backendBreaker
+		if p.CircuitBreaker != nil {
+			breaker = breakerFor(p.Service, backend.Addr)
+			if ok, _ := breaker.allow(p.CircuitBreaker, time.Now()); !ok {
+				lastErr = errCircuitOpen
+				continue
+			}
+		}
+
+		start := time.Now()
+		if err := p.tryBackend(w, req, backend, upgrade); err != nil {
+			if breaker != nil {
+				breaker.recordFailure(p.CircuitBreaker, time.Now())
+			}
+			lastErr = err
+			p.logger().Printf("router: proxy error to backend %s: %s", backend.Addr, err)
+			if p.Metrics != nil {
+				p.Metrics.IncBackendError(metrics.RequestLabels{Route: p.Route, Domain: p.Domain, Service: p.Service})
+			}
+			if info != nil {
+				info.Retries++
+			}
+			var opErr *net.OpError
+			if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "write") {
+				continue
+			}
+			// Any later failure means the backend may already have
+			// received the request, so it isn't retried elsewhere.
+			break
+		}
+		if breaker != nil {
+			breaker.recordSuccess()
+		}
+		if !upgrade {
+			// An Upgrade connection's tryBackend call blocks for the
+			// tunnelled connection's whole lifetime, so its duration
+			// isn't a response latency sample.
+			p.selector().recordLatency(backend, time.Since(start))
+		}
+		if info != nil {
+			info.Backend = backend.Addr
+		}
+		if p.Stickiness != nil {
+			p.Stickiness.record(w, req, backend, backend == pinned)
+		}
+		return
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no backends available")
+	}
+	http.Error(w, "Service Unavailable", 503)
+}
+
+// order returns the backends in the order they should be attempted: the
+// pinned backend first (if Stickiness pins this request to one that's
+// still present, short-circuiting Selector entirely), then the
+// remaining backends as ordered by Selector.
+func (p *Proxy) order(req *http.Request, backends []*Backend) (order []*Backend, pinned *Backend) {
+	if p.Stickiness != nil {
+		pinned = p.Stickiness.pin(req, backends)
+	}
+
+	rest := make([]*Backend, 0, len(backends))
+	for _, b := range backends {
+		if b == pinned || b.Draining {
+			continue
+		}
+		rest = append(rest, b)
+	}
+	rest = p.selector().order(rest)
+
+	if pinned != nil {
+		return append([]*Backend{pinned}, rest...), pinned
+	}
+	return rest, nil
+}
+
+func (p *Proxy) tryBackend(w http.ResponseWriter, req *http.Request, backend *Backend, upgrade bool) error {
+	atomic.AddInt64(&backend.inflight, 1)
+	defer atomic.AddInt64(&backend.inflight, -1)
+
+	if upgrade {
+		return p.proxyUpgrade(w, req, backend)
+	}
+	return p.proxyHTTP(w, req, backend)
+}
+
+func (p *Proxy) proxyHTTP(w http.ResponseWriter, req *http.Request, backend *Backend) error {
+	scheme := "http"
+	if p.BackendProtocol == router.BackendProtocolH2 || (p.BackendTLS != nil && p.BackendTLS.Enabled) {
+		if _, err := p.backendTLSConfig(); err != nil {
+			return err
+		}
+		scheme = "https"
+	}
+	rp := &httputil.ReverseProxy{
+		Director: func(out *http.Request) {
+			out.URL.Scheme = scheme
+			out.URL.Host = backend.Addr
+			out.Close = req.Close
+		},
+		Transport:     p.backendTransport(),
+		FlushInterval: 50 * time.Millisecond,
+		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+			panic(errBackendUnreachable{err})
+		},
+	}
+	if p.Stickiness != nil {
+		rp.ModifyResponse = func(resp *http.Response) error {
+			p.Stickiness.observeResponse(resp, backend)
+			return nil
+		}
+	}
+
+	err := func() (err error) {
+		defer func() {
+			if v := recover(); v != nil {
+				if be, ok := v.(errBackendUnreachable); ok {
+					err = be.err
+					return
+				}
+				panic(v)
+			}
+		}()
+		// httputil.ReverseProxy appends the peer's address to
+		// X-Forwarded-For whenever it can parse RemoteAddr; the header
+		// has already been set (or stripped) by the listener, so the copy
+		// handed to it carries no RemoteAddr.
+		out := req.WithContext(req.Context())
+		out.RemoteAddr = ""
+		rp.ServeHTTP(w, out)
+		return nil
+	}()
+	return err
+}
+
+type errBackendUnreachable struct{ err error }
+
+func (e errBackendUnreachable) Error() string { return e.err.Error() }
+
+func (p *Proxy) backendTransport() http.RoundTripper {
+	if p.transport != nil {
+		return p.transport
+	}
+
+	switch p.BackendProtocol {
+	case router.BackendProtocolH2:
+		tlsConfig, _ := p.backendTLSConfig()
+		p.transport = &http2.Transport{
+			TLSClientConfig: tlsConfig,
+		}
+	case router.BackendProtocolH2C:
+		// http2.Transport requires TLS unless AllowHTTP is set, in
+		// which case it dials with DialTLSContext even for an "http"
+		// URL, so that's pointed at a plain TCP dial instead. Unlike
+		// the http/1.1 Transport below, it has no IdleConnTimeout:
+		// h2's single multiplexed connection per backend is kept
+		// alive by the ConnPool rather than closed and reopened on
+		// idle, so p.IdleTimeout doesn't apply here.
+		p.transport = &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{Timeout: p.connectTimeout()}).DialContext(ctx, network, addr)
+			},
+		}
+	default:
+		t := &http.Transport{
+			DisableKeepAlives:     p.DisableKeepAlives,
+			DialContext:           (&net.Dialer{Timeout: p.connectTimeout()}).DialContext,
+			ResponseHeaderTimeout: p.ResponseHeaderTimeout,
+			IdleConnTimeout:       p.IdleTimeout,
+		}
+		if p.BackendTLS != nil && p.BackendTLS.Enabled {
+			// backendTLSConfig's error, if any, is surfaced to the
+			// caller by proxyHTTP before this transport is ever used.
+			t.TLSClientConfig, _ = p.backendTLSConfig()
+		}
+		p.transport = t
+	}
+	return p.transport
+}
+
+// backendTLSConfig builds (and caches) the *tls.Config used to dial
+// backends when BackendTLS.Enabled is set.
+func (p *Proxy) backendTLSConfig() (*tls.Config, error) {
+	if p.tlsConfig != nil || p.tlsConfigErr != nil {
+		return p.tlsConfig, p.tlsConfigErr
+	}
+
+	bt := p.BackendTLS
+	if bt == nil {
+		// A route can set BackendProtocolH2 without a BackendTLS block
+		// (H2 to backends always goes over TLS, but there's nothing to
+		// customize about it), so fall back to verifying with the
+		// system roots.
+		bt = &router.BackendTLS{}
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: bt.InsecureSkipVerify,
+		ServerName:         bt.ServerName,
+	}
+
+	if !bt.InsecureSkipVerify && len(bt.CACerts) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bt.CACerts) {
+			p.tlsConfigErr = fmt.Errorf("proxy: no certificates found in BackendTLS.CACerts")
+			return nil, p.tlsConfigErr
+		}
+		cfg.RootCAs = pool
+	}
+
+	if len(bt.ClientCert) > 0 && len(bt.ClientKey) > 0 {
+		cert, err := tls.X509KeyPair(bt.ClientCert, bt.ClientKey)
+		if err != nil {
+			p.tlsConfigErr = err
+			return nil, p.tlsConfigErr
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	p.tlsConfig = cfg
+	return p.tlsConfig, nil
+}
+
+// dialBackend dials backend directly (bypassing backendTransport), over
+// TLS if BackendTLS.Enabled is set.
+func (p *Proxy) dialBackend(backend *Backend) (net.Conn, error) {
+	if p.BackendTLS != nil && p.BackendTLS.Enabled {
+		tlsConfig, err := p.backendTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		return tls.DialWithDialer(&net.Dialer{Timeout: p.connectTimeout()}, "tcp", backend.Addr, tlsConfig)
+	}
+	return net.DialTimeout("tcp", backend.Addr, p.connectTimeout())
+}
+
+// proxyUpgrade dials backend directly and pipes the hijacked client
+// connection to it verbatim, after forwarding the original request
+// line and headers. This is used for websockets and other Upgrade
+// requests that httputil.ReverseProxy cannot tunnel.
+func (p *Proxy) proxyUpgrade(w http.ResponseWriter, req *http.Request, backend *Backend) error {
+	beConn, err := p.dialBackend(backend)
+	if err != nil {
+		return err
+	}
+	defer beConn.Close()
+
+	// The backend always speaks HTTP/1.1 Upgrade semantics, regardless
+	// of how the client reached us, so an inbound RFC 8441 extended
+	// CONNECT is translated to the equivalent Upgrade request.
+	beReq := req
+	if req.ProtoMajor >= 2 && req.Method == http.MethodConnect {
+		beReq = upgradeRequestFromExtendedConnect(req)
+	}
+	if err := beReq.Write(beConn); err != nil {
+		return err
+	}
+
+	if hj, ok := w.(http.Hijacker); ok {
+		conn, buf, err := hj.Hijack()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		errc := make(chan error, 2)
+		go proxyCopy(errc, beConn, buf)
+		go proxyCopy(errc, conn, bufio.NewReader(beConn))
+		<-errc
+		return nil
+	}
+
+	// No Hijacker means this is an HTTP/2 extended CONNECT stream: the
+	// tunnel is instead the bidirectional pair of req.Body (reads) and
+	// w (writes), with the backend's own HTTP/1.1 Upgrade handshake
+	// consumed first and not forwarded to the client verbatim.
+	beResp, err := http.ReadResponse(bufio.NewReader(beConn), beReq)
+	if err != nil {
+		return err
+	}
+	defer beResp.Body.Close()
+	if beResp.StatusCode != http.StatusSwitchingProtocols {
+		w.WriteHeader(beResp.StatusCode)
+		_, err := io.Copy(w, beResp.Body)
+		return err
+	}
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	errc := make(chan error, 2)
+	go proxyCopy(errc, beConn, req.Body)
+	go proxyCopy(errc, flushWriter{w}, beConn)
+	<-errc
+	return nil
+}
+
+// upgradeRequestFromExtendedConnect translates an HTTP/2 RFC 8441
+// extended CONNECT request into the HTTP/1.1 GET+Upgrade request the
+// backend expects, carrying over everything but the pseudo-headers that
+// don't have an HTTP/1.1 analog.
+func upgradeRequestFromExtendedConnect(req *http.Request) *http.Request {
+	out := req.Clone(req.Context())
+	out.Method = http.MethodGet
+	out.Proto = "HTTP/1.1"
+	out.ProtoMajor = 1
+	out.ProtoMinor = 1
+	out.Header.Set("Connection", "Upgrade")
+	if out.Header.Get("Upgrade") == "" {
+		out.Header.Set("Upgrade", "websocket")
+	}
+	return out
+}
+
+// flushWriter wraps an io.Writer, flushing after every write if it
+// implements http.Flusher, so a streamed response isn't buffered
+// indefinitely by the server.
+type flushWriter struct {
+	w io.Writer
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+func proxyCopy(errc chan<- error, dst io.Writer, src io.Reader) {
+	_, err := io.Copy(dst, src)
+	errc <- err
+}
+
+func isUpgrade(req *http.Request) bool {
+	// RFC 8441 extended CONNECT (HTTP/2's replacement for the Upgrade
+	// mechanism) carries no Connection/Upgrade headers at all.
+	if req.ProtoMajor >= 2 && req.Method == http.MethodConnect {
+		return true
+	}
+	for _, v := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// NewRequestID returns a new v4-ish UUID string suitable for the
+// X-Request-Id header.
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// BackendFromRoute converts router.Backend values (as returned by
+// discoverd) into proxy Backends.
+func BackendFromRoute(b *router.Backend) *Backend {
+	return &Backend{Addr: b.Addr, JobID: b.JobID}
+}
+
+func mustPort(addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return port
+}
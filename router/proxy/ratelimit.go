@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// rateLimitLRUSize bounds the number of distinct keys (e.g. client IPs)
+// tracked per configured limit, so a route that buckets by a
+// high-cardinality key can't grow memory without limit.
+const rateLimitLRUSize = 65536
+
+// RateLimiter enforces a route's configured RateLimits. Each limit is a
+// token bucket keyed by a value extracted from the request; buckets are
+// held in a bounded, least-recently-used set.
+type RateLimiter struct {
+	limits []*compiledLimit
+}
+
+type compiledLimit struct {
+	router.RateLimit
+	extract keyExtractor
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	order   *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// keyExtractor pulls the bucketing key out of a request, reporting
+// false if the request carries no such key (in which case the limit it
+// belongs to is skipped for that request).
+type keyExtractor func(*http.Request) (string, bool)
+
+// NewRateLimiter compiles route-level rate limit configuration into a
+// RateLimiter. Limits with an unrecognized ExtractorKey are dropped
+// rather than rejected, so new extractors can be introduced without
+// breaking routes configured for them on a router that predates the
+// extractor.
+func NewRateLimiter(limits []router.RateLimit) *RateLimiter {
+	var compiled []*compiledLimit
+	for _, l := range limits {
+		extract := extractorFor(l.ExtractorKey)
+		if extract == nil || l.Average <= 0 || l.Period <= 0 {
+			continue
+		}
+		burst := l.Burst
+		if burst < l.Average {
+			burst = l.Average
+		}
+		l.Burst = burst
+		compiled = append(compiled, &compiledLimit{
+			RateLimit: l,
+			extract:   extract,
+			buckets:   make(map[string]*list.Element),
+			order:     list.New(),
+		})
+	}
+	if len(compiled) == 0 {
+		return nil
+	}
+	return &RateLimiter{limits: compiled}
+}
+
+func extractorFor(key string) keyExtractor {
+	switch {
+	case key == "" || key == "client_ip":
+		return func(req *http.Request) (string, bool) {
+			// X-Forwarded-For's leftmost entry is the original
+			// client whenever the listener trusted the peer it
+			// came in on (see HTTPListener.setForwardedHeaders);
+			// otherwise it's set to RemoteAddr, so using it
+			// unconditionally rate-limits the real client rather
+			// than a trusted load balancer's single address.
+			if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
+				if i := strings.IndexByte(xff, ','); i >= 0 {
+					xff = xff[:i]
+				}
+				return strings.TrimSpace(xff), true
+			}
+			host, _, err := net.SplitHostPort(req.RemoteAddr)
+			if err != nil {
+				host = req.RemoteAddr
+			}
+			return host, host != ""
+		}
+	case strings.HasPrefix(key, "header:"):
+		name := strings.TrimPrefix(key, "header:")
+		return func(req *http.Request) (string, bool) {
+			v := req.Header.Get(name)
+			return v, v != ""
+		}
+	case strings.HasPrefix(key, "cookie:"):
+		name := strings.TrimPrefix(key, "cookie:")
+		return func(req *http.Request) (string, bool) {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return "", false
+			}
+			return cookie.Value, true
+		}
+	default:
+		return nil
+	}
+}
+
+// Allow reports whether req may proceed under every configured limit,
+// consuming a token from each bucket it matches. When a limit rejects
+// the request, retryAfter is the time the client should wait before
+// retrying. A nil *RateLimiter always allows the request, so routes
+// without RateLimits configured pay no extra cost.
+func (r *RateLimiter) Allow(req *http.Request) (allowed bool, retryAfter time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+	allowed = true
+	for _, l := range r.limits {
+		value, ok := l.extract(req)
+		if !ok {
+			continue
+		}
+		ok, wait := l.take(hashKey(value))
+		if !ok {
+			allowed = false
+			if wait > retryAfter {
+				retryAfter = wait
+			}
+		}
+	}
+	return allowed, retryAfter
+}
+
+// hashKey hashes the extracted value so that bucket identity doesn't
+// leak raw client data (IPs, header/cookie values) through memory
+// dumps or metrics, and so additional extractor plugins can share the
+// same key space without collisions.
+func hashKey(v string) string {
+	sum := sha1.Sum([]byte(v))
+	return hex.EncodeToString(sum[:])
+}
+
+// take consumes a token from the bucket identified by key, refilling it
+// based on elapsed monotonic time since it was last touched.
+func (l *compiledLimit) take(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var b *bucket
+	if el, ok := l.buckets[key]; ok {
+		b = el.Value.(*bucket)
+		l.order.MoveToFront(el)
+	} else {
+		b = &bucket{key: key, tokens: float64(l.Burst), last: now}
+		l.buckets[key] = l.order.PushFront(b)
+		l.evict()
+	}
+
+	refillRate := float64(l.Average) / l.Period.Seconds()
+	b.tokens += now.Sub(b.last).Seconds() * refillRate
+	if b.tokens > float64(l.Burst) {
+		b.tokens = float64(l.Burst)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / refillRate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *compiledLimit) evict() {
+	for len(l.buckets) > rateLimitLRUSize {
+		el := l.order.Back()
+		if el == nil {
+			return
+		}
+		l.order.Remove(el)
+		delete(l.buckets, el.Value.(*bucket).key)
+	}
+}
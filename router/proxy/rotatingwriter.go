@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RotatingWriter is an io.Writer backed by a file that's rotated to
+// <path>.<timestamp> once it exceeds MaxBytes or has been open longer
+// than MaxAge, whichever comes first, and reopened at <path>. Writes
+// are serialized and never block on rotation for longer than the
+// rename+reopen itself, so a slow disk doesn't stall request handling
+// beyond that.
+type RotatingWriter struct {
+	Path     string
+	MaxBytes int64
+	MaxAge   time.Duration
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+// NewRotatingWriter opens (creating if necessary) the file at path.
+func NewRotatingWriter(path string, maxBytes int64, maxAge time.Duration) (*RotatingWriter, error) {
+	w := &RotatingWriter{Path: path, MaxBytes: maxBytes, MaxAge: maxAge}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *RotatingWriter) open() error {
+	f, err := os.OpenFile(w.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = info.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+// Write writes p, rotating first if this write would exceed MaxBytes or
+// the current file is older than MaxAge.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+func (w *RotatingWriter) shouldRotate(nextWrite int) bool {
+	if w.MaxBytes > 0 && w.size+int64(nextWrite) > w.MaxBytes {
+		return true
+	}
+	if w.MaxAge > 0 && time.Since(w.opened) > w.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (w *RotatingWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", w.Path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(w.Path, rotated); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the underlying file.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// BackendSelector orders a request's non-pinned candidate backends,
+// most-preferred first.
+type BackendSelector interface {
+	order(backends []*Backend) []*Backend
+
+	// recordLatency is called once backend has successfully served a
+	// non-Upgrade request, with how long that took, so a latency-aware
+	// selector can update its estimate. Selectors indifferent to
+	// latency no-op.
+	recordLatency(backend *Backend, d time.Duration)
+}
+
+// NewBackendSelector builds the BackendSelector named by a route's
+// BackendSelector field, defaulting to BackendSelectorLeastInflight for
+// an empty or unrecognized name. service scopes an EWMA selector's
+// learned latencies the same way CircuitBreaker's are scoped.
+func NewBackendSelector(name, service string) BackendSelector {
+	switch name {
+	case router.BackendSelectorP2C:
+		return p2cSelector{}
+	case router.BackendSelectorEWMA:
+		return &ewmaSelector{service: service}
+	default:
+		return leastInflightSelector{}
+	}
+}
+
+// leastInflightSelector orders backends by ascending in-flight request
+// count; this was the proxy's original (and still default) behavior.
+type leastInflightSelector struct{}
+
+func (leastInflightSelector) order(backends []*Backend) []*Backend {
+	ordered := append([]*Backend(nil), backends...)
+	for i := 1; i < len(ordered); i++ {
+		for j := i; j > 0 && ordered[j].Inflight() < ordered[j-1].Inflight(); j-- {
+			ordered[j], ordered[j-1] = ordered[j-1], ordered[j]
+		}
+	}
+	return ordered
+}
+
+func (leastInflightSelector) recordLatency(backend *Backend, d time.Duration) {}
+
+// p2cSelector implements power-of-two-choices: it repeatedly samples
+// two random backends from what's left and keeps the one with fewer
+// in-flight requests, approximating least-loaded selection without the
+// cost of sorting every backend on every request.
+type p2cSelector struct{}
+
+func (p2cSelector) order(backends []*Backend) []*Backend {
+	remaining := append([]*Backend(nil), backends...)
+	ordered := make([]*Backend, 0, len(remaining))
+	for len(remaining) > 1 {
+		i := rand.Intn(len(remaining))
+		j := rand.Intn(len(remaining) - 1)
+		if j >= i {
+			j++
+		}
+		winner := i
+		if remaining[j].Inflight() < remaining[i].Inflight() {
+			winner = j
+		}
+		ordered = append(ordered, remaining[winner])
+		remaining = append(remaining[:winner], remaining[winner+1:]...)
+	}
+	if len(remaining) == 1 {
+		ordered = append(ordered, remaining[0])
+	}
+	return ordered
+}
+
+func (p2cSelector) recordLatency(backend *Backend, d time.Duration) {}
+
+// ewmaAlpha weights how quickly a backend's moving average responds to
+// a new latency sample relative to its history.
+const ewmaAlpha = 0.3
+
+// ewmaStat is a single backend's learned average response time.
+type ewmaStat struct {
+	mu  sync.Mutex
+	avg time.Duration
+}
+
+func (s *ewmaStat) record(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.avg == 0 {
+		s.avg = d
+		return
+	}
+	s.avg = time.Duration(ewmaAlpha*float64(d) + (1-ewmaAlpha)*float64(s.avg))
+}
+
+// score combines the learned average with inflight so a backend that
+// currently looks fast doesn't get piled onto the moment it's observed,
+// and a backend with no samples yet isn't starved of traffic for lack
+// of history.
+func (s *ewmaStat) score(inflight int64) float64 {
+	s.mu.Lock()
+	avg := s.avg
+	s.mu.Unlock()
+	if avg == 0 {
+		avg = time.Millisecond
+	}
+	return float64(avg) * float64(inflight+1)
+}
+
+// ewmaStats is the process-wide, bounded registry of per-backend
+// latency averages, keyed by "service|addr" the same way breakers is,
+// so learned latencies survive a route's Proxy being rebuilt on every
+// config sync.
+var ewmaStats = newBackendState[*ewmaStat]()
+
+func ewmaStatFor(service, addr string) *ewmaStat {
+	return ewmaStats.getOrCreate(service+"|"+addr, func() *ewmaStat { return &ewmaStat{} })
+}
+
+// ewmaSelector biases selection toward backends with a lower recent
+// average response time, weighted by in-flight count.
+type ewmaSelector struct {
+	service string
+}
+
+func (e *ewmaSelector) order(backends []*Backend) []*Backend {
+	ordered := append([]*Backend(nil), backends...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		si := ewmaStatFor(e.service, ordered[i].Addr).score(ordered[i].Inflight())
+		sj := ewmaStatFor(e.service, ordered[j].Addr).score(ordered[j].Inflight())
+		return si < sj
+	})
+	return ordered
+}
+
+func (e *ewmaSelector) recordLatency(backend *Backend, d time.Duration) {
+	ewmaStatFor(e.service, backend.Addr).record(d)
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	router "github.com/flynn/flynn/router/types"
+)
+
+// StickinessMode pins a sticky route's requests to the same backend,
+// using whatever strategy its implementation defines.
+type StickinessMode interface {
+	// pin returns the backend req is already pinned to, if any and if
+	// it's still present in backends.
+	pin(req *http.Request, backends []*Backend) *Backend
+
+	// record is called once backend has successfully served req, so a
+	// mode that pins via a proxy-set cookie (DurationBased) can
+	// establish or refresh it. Modes that pin without any
+	// proxy-side bookkeeping no-op.
+	record(w http.ResponseWriter, req *http.Request, backend *Backend, alreadyPinned bool)
+
+	// observeResponse is called with backend's response before it's
+	// written to the client, so a mode that pins by watching the
+	// backend's own cookie (ApplicationCookie) can learn the mapping.
+	// Modes that don't need to inspect responses no-op.
+	observeResponse(resp *http.Response, backend *Backend)
+}
+
+// NewStickinessMode builds the StickinessMode described by route, or nil
+// if route isn't Sticky. secrets signs StickinessModeDuration's cookie
+// value; see the router's HTTPListener.StickyCookieSecrets.
+func NewStickinessMode(route *router.Route, secrets [][]byte) StickinessMode {
+	if !route.Sticky {
+		return nil
+	}
+	switch route.StickinessMode {
+	case router.StickinessModeApplicationCookie:
+		name := route.ApplicationCookieName
+		if name == "" {
+			name = "JSESSIONID"
+		}
+		return newApplicationCookieStickiness(name)
+	case router.StickinessModeConsistentHash:
+		extract := extractorFor(route.HashKey)
+		if extract == nil {
+			extract = extractorFor("client_ip")
+		}
+		return &consistentHashStickiness{extract: extract}
+	default:
+		return &durationStickiness{cookie: route.StickyCookie, secrets: secrets}
+	}
+}
+
+// durationStickiness is StickinessModeDuration: the proxy sets its own
+// signed cookie naming the backend.
+type durationStickiness struct {
+	cookie  *router.StickyCookie
+	secrets [][]byte
+}
+
+func (d *durationStickiness) cookieName() string {
+	if d.cookie != nil && d.cookie.Name != "" {
+		return d.cookie.Name
+	}
+	return StickyCookieName
+}
+
+func (d *durationStickiness) pin(req *http.Request, backends []*Backend) *Backend {
+	cookie, err := req.Cookie(d.cookieName())
+	if err != nil {
+		return nil
+	}
+	identifier, ok := verifyStickyValue(cookie.Value, d.secrets)
+	if !ok {
+		// A value that fails verification is silently treated as a
+		// sticky miss: the request falls back to ordinary load
+		// balancing rather than being rejected outright.
+		return nil
+	}
+	for _, b := range backends {
+		if b.JobID == identifier || b.Addr == identifier {
+			return b
+		}
+	}
+	return nil
+}
+
+func (d *durationStickiness) record(w http.ResponseWriter, req *http.Request, backend *Backend, alreadyPinned bool) {
+	if alreadyPinned {
+		return
+	}
+
+	identifier := backend.JobID
+	if identifier == "" {
+		identifier = backend.Addr
+	}
+
+	cookie := &http.Cookie{
+		Name:     StickyCookieName,
+		Value:    signStickyValue(identifier, d.secrets),
+		Path:     "/",
+		Secure:   req.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if d.cookie != nil {
+		if d.cookie.Name != "" {
+			cookie.Name = d.cookie.Name
+		}
+		if d.cookie.Path != "" {
+			cookie.Path = d.cookie.Path
+		}
+		cookie.Domain = d.cookie.Domain
+		cookie.MaxAge = d.cookie.MaxAge
+		if d.cookie.Secure != nil {
+			cookie.Secure = *d.cookie.Secure
+		}
+		if d.cookie.HTTPOnly != nil {
+			cookie.HttpOnly = *d.cookie.HTTPOnly
+		}
+		switch d.cookie.SameSite {
+		case router.StickyCookieSameSiteStrict:
+			cookie.SameSite = http.SameSiteStrictMode
+		case router.StickyCookieSameSiteNone:
+			cookie.SameSite = http.SameSiteNoneMode
+		}
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func (d *durationStickiness) observeResponse(resp *http.Response, backend *Backend) {}
+
+// signStickyValue returns the cookie value naming backend identifier:
+// identifier itself if no secret is configured (the proxy's original
+// behavior), or an opaque, HMAC-SHA256-signed token under the first
+// (current) secret otherwise.
+func signStickyValue(identifier string, secrets [][]byte) string {
+	if len(secrets) == 0 {
+		return identifier
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(identifier)) + "." + stickySignature(identifier, secrets[0])
+}
+
+// verifyStickyValue recovers the backend identifier named by a sticky
+// cookie's value, checking its signature against every configured
+// secret so a cookie signed under a since-rotated secret is still
+// honored until that secret too is removed. ok is false for a value
+// that's malformed or doesn't verify under any configured secret, in
+// which case identifier must not be used.
+func verifyStickyValue(value string, secrets [][]byte) (identifier string, ok bool) {
+	if len(secrets) == 0 {
+		return value, true
+	}
+	idPart, sigPart, found := strings.Cut(value, ".")
+	if !found {
+		return "", false
+	}
+	idBytes, err := base64.RawURLEncoding.DecodeString(idPart)
+	if err != nil {
+		return "", false
+	}
+	identifier = string(idBytes)
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(sigPart), []byte(stickySignature(identifier, secret))) {
+			return identifier, true
+		}
+	}
+	return "", false
+}
+
+func stickySignature(identifier string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(identifier))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// appCookieLRUSize bounds the number of distinct application cookie
+// values tracked per route, so a backend that never expires its session
+// cookie can't grow the mapping without limit.
+const appCookieLRUSize = 65536
+
+// applicationCookieStickiness is StickinessModeApplicationCookie: it
+// watches for the backend setting its own session cookie and remembers
+// which backend issued each value, without ever setting a cookie of its
+// own.
+type applicationCookieStickiness struct {
+	cookieName string
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type appCookieEntry struct {
+	value string
+	addr  string
+}
+
+func newApplicationCookieStickiness(cookieName string) *applicationCookieStickiness {
+	return &applicationCookieStickiness{
+		cookieName: cookieName,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func (a *applicationCookieStickiness) pin(req *http.Request, backends []*Backend) *Backend {
+	cookie, err := req.Cookie(a.cookieName)
+	if err != nil {
+		return nil
+	}
+
+	a.mu.Lock()
+	el, ok := a.entries[cookie.Value]
+	if ok {
+		a.order.MoveToFront(el)
+	}
+	a.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	addr := el.Value.(*appCookieEntry).addr
+	for _, b := range backends {
+		if b.Addr == addr {
+			return b
+		}
+	}
+	return nil
+}
+
+func (a *applicationCookieStickiness) record(w http.ResponseWriter, req *http.Request, backend *Backend, alreadyPinned bool) {
+}
+
+func (a *applicationCookieStickiness) observeResponse(resp *http.Response, backend *Backend) {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name != a.cookieName {
+			continue
+		}
+		a.mu.Lock()
+		if el, ok := a.entries[cookie.Value]; ok {
+			a.order.MoveToFront(el)
+		} else {
+			a.entries[cookie.Value] = a.order.PushFront(&appCookieEntry{value: cookie.Value, addr: backend.Addr})
+			for len(a.entries) > appCookieLRUSize {
+				back := a.order.Back()
+				if back == nil {
+					break
+				}
+				a.order.Remove(back)
+				delete(a.entries, back.Value.(*appCookieEntry).value)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+// consistentHashReplicas is the number of virtual nodes placed on the
+// ring per backend; enough that adding or removing one backend only
+// remaps roughly 1/N of keys, rather than whole buckets of them.
+const consistentHashReplicas = 150
+
+// consistentHashStickiness is StickinessModeConsistentHash: it hashes a
+// request-derived key onto a ring of backends, needing no cookie and
+// surviving router restarts since the mapping is deterministic.
+type consistentHashStickiness struct {
+	extract keyExtractor
+
+	mu          sync.Mutex
+	ring        *hashRing
+	fingerprint string
+}
+
+func (c *consistentHashStickiness) pin(req *http.Request, backends []*Backend) *Backend {
+	key, ok := c.extract(req)
+	if !ok {
+		return nil
+	}
+	return c.ringFor(backends).get(key)
+}
+
+func (c *consistentHashStickiness) ringFor(backends []*Backend) *hashRing {
+	fp := ringFingerprint(backends)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ring == nil || c.fingerprint != fp {
+		c.ring = newHashRing(backends, consistentHashReplicas)
+		c.fingerprint = fp
+	}
+	return c.ring
+}
+
+func (c *consistentHashStickiness) record(w http.ResponseWriter, req *http.Request, backend *Backend, alreadyPinned bool) {
+}
+
+func (c *consistentHashStickiness) observeResponse(resp *http.Response, backend *Backend) {}
+
+// ringFingerprint identifies a backend set for the purpose of deciding
+// whether a consistentHashStickiness's cached ring is stale.
+func ringFingerprint(backends []*Backend) string {
+	addrs := make([]string, len(backends))
+	for i, b := range backends {
+		addrs[i] = b.Addr
+	}
+	sort.Strings(addrs)
+	return strings.Join(addrs, ",")
+}
+
+// hashRing maps hashed keys to backends via consistent hashing with
+// virtual nodes.
+type hashRing struct {
+	points   []uint32
+	backends map[uint32]*Backend
+}
+
+func newHashRing(backends []*Backend, replicas int) *hashRing {
+	r := &hashRing{backends: make(map[uint32]*Backend, len(backends)*replicas)}
+	for _, b := range backends {
+		for i := 0; i < replicas; i++ {
+			h := fnv32a(b.Addr + "#" + strconv.Itoa(i))
+			r.points = append(r.points, h)
+			r.backends[h] = b
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// get returns the backend owning the first point on the ring at or
+// after key's hash, wrapping around to the first point if key hashes
+// past the last one.
+func (r *hashRing) get(key string) *Backend {
+	if len(r.points) == 0 {
+		return nil
+	}
+	h := fnv32a(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.backends[r.points[i]]
+}
+
+func fnv32a(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/flynn/flynn/router/gatewayapi"
+	router "github.com/flynn/flynn/router/types"
+)
+
+// controllerStore is the production DataStore, backed by the
+// controller's route API. The controller client and the SSE-based
+// streaming implementation live outside this package; this is the thin
+// adapter the HTTPListener syncs against.
+type controllerStore struct {
+	client controllerClient
+}
+
+// controllerClient is the subset of the controller API the router
+// depends on for route replication.
+type controllerClient struct{}
+
+func newControllerStore() *controllerStore {
+	return &controllerStore{}
+}
+
+func (s *controllerStore) List() ([]*router.Route, error) {
+	return nil, fmt.Errorf("router: controller store not configured")
+}
+
+func (s *controllerStore) StreamEvents(events chan *router.Event) (Stream, error) {
+	return nil, fmt.Errorf("router: controller store not configured")
+}
+
+// gatewayAPIStore adapts a *gatewayapi.Store, which knows nothing of
+// this package's Stream type, to DataStore.
+type gatewayAPIStore struct {
+	*gatewayapi.Store
+}
+
+// newGatewayAPIStore returns a DataStore that replicates routes from the
+// Gateway API resources described by cfg, for use in place of (or
+// alongside) newControllerStore.
+func newGatewayAPIStore(cfg gatewayapi.Config) (DataStore, error) {
+	store, err := gatewayapi.NewStore(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &gatewayAPIStore{store}, nil
+}
+
+func (s *gatewayAPIStore) StreamEvents(events chan *router.Event) (Stream, error) {
+	return s.Store.StreamEvents(events)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	router "github.com/flynn/flynn/router/types"
+)
+
+// DataStore is the source of truth that a Syncer replicates routes
+// from. In production it is backed by the controller's route API over
+// a streaming HTTP connection; tests use an in-memory fake.
+type DataStore interface {
+	// List returns the current set of routes.
+	List() ([]*router.Route, error)
+
+	// StreamEvents sends route events to events as they occur. The
+	// returned Stream is closed (either by the store or by the
+	// underlying connection dropping) when the caller should stop
+	// reading from events and reconnect.
+	StreamEvents(events chan *router.Event) (Stream, error)
+}
+
+// Stream represents a live subscription to route events.
+type Stream interface {
+	// Err returns the error that caused the stream to close, if any.
+	Err() error
+}
+
+// SyncHandler receives the routes a Syncer replicates.
+type SyncHandler interface {
+	Set(route *router.Route) error
+	Remove(id string) error
+
+	// Current is called once the initial listing has been fully
+	// applied, before any incremental events are delivered.
+	Current()
+}
+
+// Syncer keeps a SyncHandler up to date with the routes of a given type
+// held in a DataStore.
+type Syncer struct {
+	store     DataStore
+	routeType string
+}
+
+// NewSyncer returns a Syncer that replicates routes of routeType from
+// store.
+func NewSyncer(store DataStore, routeType string) *Syncer {
+	return &Syncer{store: store, routeType: routeType}
+}
+
+// Sync lists the current routes and applies them to h, then streams
+// incremental events to h until the underlying stream closes, at which
+// point it returns so the caller can reconnect and call Sync again.
+func (s *Syncer) Sync(h SyncHandler) error {
+	routes, err := s.store.List()
+	if err != nil {
+		return err
+	}
+	for _, route := range routes {
+		if route.Type != s.routeType {
+			continue
+		}
+		if err := h.Set(route); err != nil {
+			return err
+		}
+	}
+	h.Current()
+
+	events := make(chan *router.Event)
+	stream, err := s.store.StreamEvents(events)
+	if err != nil {
+		return err
+	}
+	for event := range events {
+		if event.Route != nil && event.Route.Type != s.routeType {
+			continue
+		}
+		var err error
+		switch event.Event {
+		case "set":
+			err = h.Set(event.Route)
+		case "remove":
+			err = h.Remove(event.ID)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return stream.Err()
+}
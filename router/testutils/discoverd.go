@@ -0,0 +1,158 @@
+package testutils
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	discoverd "github.com/flynn/flynn/discoverd/client"
+	"github.com/flynn/flynn/pkg/stream"
+)
+
+// FakeDiscoverd is an in-memory stand-in for *discoverd.Client, covering
+// the subset of the wire API HTTPListener depends on (AddService,
+// RegisterInstance, Service, Instances), so router tests don't need a
+// real etcd-backed discoverd process.
+type FakeDiscoverd struct {
+	mu       sync.Mutex
+	services map[string]map[string]*discoverd.Instance
+	leaders  map[string]string
+}
+
+// NewFakeDiscoverd returns an empty FakeDiscoverd.
+func NewFakeDiscoverd() *FakeDiscoverd {
+	return &FakeDiscoverd{
+		services: make(map[string]map[string]*discoverd.Instance),
+		leaders:  make(map[string]string),
+	}
+}
+
+// AddService declares service, so Instances/Service on it return empty
+// results instead of nothing having been registered at all.
+func (d *FakeDiscoverd) AddService(service string, config *discoverd.ServiceConfig) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.services[service] == nil {
+		d.services[service] = make(map[string]*discoverd.Instance)
+	}
+	return nil
+}
+
+// RegisterInstance adds inst to service, returning a Heartbeater whose
+// Close unregisters it again, the same lifecycle a real heartbeat
+// expiring would produce.
+func (d *FakeDiscoverd) RegisterInstance(service string, inst *discoverd.Instance) (discoverd.Heartbeater, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.services[service] == nil {
+		d.services[service] = make(map[string]*discoverd.Instance)
+	}
+	d.services[service][inst.ID] = inst
+	return &fakeHeartbeater{d: d, service: service, id: inst.ID, addr: inst.Addr}, nil
+}
+
+// Instances returns the instances currently registered for service.
+func (d *FakeDiscoverd) Instances(service string, timeout time.Duration) ([]*discoverd.Instance, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	instances := make([]*discoverd.Instance, 0, len(d.services[service]))
+	for _, inst := range d.services[service] {
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
+
+// Service returns a handle for reading/setting service's leader and
+// instances, mirroring discoverd.Client.Service.
+func (d *FakeDiscoverd) Service(service string) discoverd.Service {
+	return &fakeService{d: d, service: service}
+}
+
+func (d *FakeDiscoverd) unregister(service, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.services[service], id)
+}
+
+func (d *FakeDiscoverd) setLeader(service, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.leaders[service] = id
+}
+
+func (d *FakeDiscoverd) leader(service string) *discoverd.Instance {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.services[service][d.leaders[service]]
+}
+
+// fakeHeartbeater is the Heartbeater FakeDiscoverd.RegisterInstance
+// returns. Close is the only method router tests rely on; SetMeta/Addr/
+// SetClient are implemented only to satisfy discoverd.Heartbeater.
+type fakeHeartbeater struct {
+	d       *FakeDiscoverd
+	service string
+	id      string
+	addr    string
+}
+
+func (h *fakeHeartbeater) SetMeta(meta map[string]string) error { return nil }
+
+func (h *fakeHeartbeater) Close() error {
+	h.d.unregister(h.service, h.id)
+	return nil
+}
+
+func (h *fakeHeartbeater) Addr() string { return h.addr }
+
+func (h *fakeHeartbeater) SetClient(c *discoverd.Client) {}
+
+// fakeService is the discoverd.Service FakeDiscoverd.Service returns.
+// Leader, SetLeader, Instances and Addrs are the only methods router
+// tests exercise; the rest are implemented only to satisfy
+// discoverd.Service.
+type fakeService struct {
+	d       *FakeDiscoverd
+	service string
+}
+
+func (s *fakeService) Leader() (*discoverd.Instance, error) {
+	return s.d.leader(s.service), nil
+}
+
+func (s *fakeService) SetLeader(id string) error {
+	s.d.setLeader(s.service, id)
+	return nil
+}
+
+func (s *fakeService) Instances() ([]*discoverd.Instance, error) {
+	return s.d.Instances(s.service, 0)
+}
+
+func (s *fakeService) Addrs() ([]string, error) {
+	instances, err := s.Instances()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, len(instances))
+	for i, inst := range instances {
+		addrs[i] = inst.Addr
+	}
+	return addrs, nil
+}
+
+func (s *fakeService) Leaders(ch chan *discoverd.Instance) (stream.Stream, error) {
+	return nil, errors.New("testutils: FakeDiscoverd Leaders watching is not implemented")
+}
+
+func (s *fakeService) Watch(ch chan *discoverd.Event) (stream.Stream, error) {
+	return nil, errors.New("testutils: FakeDiscoverd Watch is not implemented")
+}
+
+func (s *fakeService) GetMeta() (*discoverd.ServiceMeta, error) {
+	return nil, errors.New("testutils: FakeDiscoverd GetMeta is not implemented")
+}
+
+func (s *fakeService) SetMeta(m *discoverd.ServiceMeta) error {
+	return errors.New("testutils: FakeDiscoverd SetMeta is not implemented")
+}
@@ -0,0 +1,89 @@
+// Package testutils provides helpers shared by router tests, chiefly
+// on-the-fly TLS certificate generation so tests don't need fixtures on
+// disk.
+package testutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// TLSCert is a PEM-encoded certificate/key pair for a single domain,
+// along with the CA (if any) that issued it.
+type TLSCert struct {
+	Cert       string
+	PrivateKey string
+	CACert     string
+}
+
+var (
+	certMu    sync.Mutex
+	certCache = make(map[string]TLSCert)
+)
+
+// TLSConfigForDomain returns a self-signed TLS certificate for domain,
+// generating and caching one the first time it is requested so that
+// repeated calls in the same test return a stable keypair.
+func TLSConfigForDomain(domain string) TLSCert {
+	certMu.Lock()
+	defer certMu.Unlock()
+	if cert, ok := certCache[domain]; ok {
+		return cert
+	}
+	cert := generateCert(domain)
+	certCache[domain] = cert
+	return cert
+}
+
+// RefreshTLSConfigForDomain regenerates the certificate for domain,
+// replacing whatever was previously cached. It is used by tests that
+// exercise certificate rotation.
+func RefreshTLSConfigForDomain(domain string) TLSCert {
+	certMu.Lock()
+	delete(certCache, domain)
+	certMu.Unlock()
+	return TLSConfigForDomain(domain)
+}
+
+func generateCert(domain string) TLSCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: domain},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{domain},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return TLSCert{
+		Cert:       string(certPEM),
+		PrivateKey: string(keyPEM),
+		CACert:     string(certPEM),
+	}
+}
@@ -0,0 +1,440 @@
+// Package router contains types shared between the router daemon, the
+// controller and API clients for describing routes.
+package router
+
+import (
+	"fmt"
+	"time"
+)
+
+// Route types understood by the router.
+const (
+	RouteTypeHTTP = "http"
+	RouteTypeTCP  = "tcp"
+)
+
+// ForwardedHeadersStrip is the Route.ForwardedHeaders value that removes
+// forwarded headers from a request instead of setting them.
+const ForwardedHeadersStrip = "strip"
+
+// Backend protocols understood by the router's proxy. BackendProtocolH2C
+// and BackendProtocolH2 both speak HTTP/2 to the backend, over
+// plaintext and TLS respectively; left empty, a route's BackendProtocol
+// defaults to BackendProtocolHTTP1.
+const (
+	BackendProtocolHTTP1 = "http/1.1"
+	BackendProtocolH2    = "h2"
+	BackendProtocolH2C   = "h2c"
+)
+
+// Certificate is a TLS certificate/key pair that may be shared between
+// multiple HTTP routes (e.g. wildcard certs).
+type Certificate struct {
+	ID     string   `json:"id,omitempty"`
+	Routes []string `json:"routes,omitempty"`
+
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// RateLimit configures a token-bucket rate limit applied to requests
+// matching a route. Requests are bucketed by a value extracted from the
+// request, named by ExtractorKey: "client_ip", "header:<Name>" or
+// "cookie:<name>". Average tokens are added per Period up to a maximum
+// of Burst.
+type RateLimit struct {
+	Period       time.Duration `json:"period"`
+	Average      int           `json:"average"`
+	Burst        int           `json:"burst"`
+	ExtractorKey string        `json:"extractor_key"`
+}
+
+// Match refines which requests a route applies to beyond its Domain and
+// Path. A nil Match means the route matches anything under its
+// Domain/Path, preserving the router's original behavior. Within a
+// single host, routes are tried in order of decreasing specificity:
+// longest Path first, ties broken by decreasing Weight.
+type Match struct {
+	// PathPrefix overrides Path as the prefix requests are matched
+	// against, letting a Match be layered onto a route without
+	// disturbing the canonical Path used for display/lookup. Left
+	// empty, the route's Path is used.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// PathRegex, if set, must also match the request path.
+	PathRegex string `json:"path_regex,omitempty"`
+	// Methods restricts the route to this set of HTTP methods. Empty
+	// matches any method.
+	Methods []string `json:"methods,omitempty"`
+	// Headers requires each named header to be present and equal to
+	// its value, or, if the value has a "regex:" prefix, to match the
+	// remainder as a regular expression.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Query requires each named query parameter to be present and
+	// equal to its value, with the same "regex:" prefix convention as
+	// Headers.
+	Query map[string]string `json:"query,omitempty"`
+	// Weight breaks ties between rules with an equally specific Path,
+	// higher values being tried first.
+	Weight int `json:"weight,omitempty"`
+}
+
+// BackendTLS configures the router to dial a route's backends over TLS
+// instead of the default plaintext HTTP.
+type BackendTLS struct {
+	Enabled bool `json:"enabled,omitempty"`
+
+	// InsecureSkipVerify disables verification of the backend's
+	// certificate chain and hostname, the same as Go's
+	// tls.Config.InsecureSkipVerify. CACerts is ignored when this is set.
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+
+	// ServerName overrides the hostname used for SNI and certificate
+	// hostname verification. Left empty, the backend's dial address is
+	// used, which is rarely what's wanted since that's usually an IP.
+	ServerName string `json:"server_name,omitempty"`
+
+	// CACerts is a PEM bundle of CA certificates trusted to sign the
+	// backend's certificate, in place of the system roots.
+	CACerts []byte `json:"ca_certs,omitempty"`
+
+	// ClientCert and ClientKey, if both set, are presented to the
+	// backend as a client certificate (mutual TLS).
+	ClientCert []byte `json:"client_cert,omitempty"`
+	ClientKey  []byte `json:"client_key,omitempty"`
+}
+
+// CircuitBreaker configures per-backend-instance failure isolation.
+// Once a backend instance accumulates Threshold consecutive failures
+// within Window, the router stops sending it requests (returning 503
+// immediately, without dialing) until Cooldown has elapsed, then allows
+// exactly one probe request through to decide whether to close the
+// circuit again or reopen it. Breaker state is kept per (service,
+// backend address), so a replacement instance registered under a new
+// address never inherits a tripped breaker.
+type CircuitBreaker struct {
+	Threshold int           `json:"threshold"`
+	Window    time.Duration `json:"window"`
+	Cooldown  time.Duration `json:"cooldown"`
+}
+
+// SameSite values understood by StickyCookie.SameSite. Left empty, a
+// sticky cookie's SameSite attribute defaults to StickyCookieSameSiteLax.
+const (
+	StickyCookieSameSiteLax    = "lax"
+	StickyCookieSameSiteStrict = "strict"
+	StickyCookieSameSiteNone   = "none"
+)
+
+// StickinessMode values understood by Route.StickinessMode, selecting
+// how a sticky route pins requests to a backend. Left empty,
+// StickinessModeDuration is implied by Sticky.
+const (
+	// StickinessModeDuration is the default strategy: the proxy sets
+	// its own cookie (StickyCookie) naming the backend, valid for as
+	// long as the cookie's MaxAge allows.
+	StickinessModeDuration = "duration"
+	// StickinessModeApplicationCookie pins by the value of a cookie the
+	// backend itself sets (ApplicationCookieName), without the proxy
+	// ever setting a cookie of its own.
+	StickinessModeApplicationCookie = "application_cookie"
+	// StickinessModeConsistentHash pins by hashing a request value
+	// (HashKey) onto a ring of backends, needing no cookie at all and
+	// surviving router restarts.
+	StickinessModeConsistentHash = "consistent_hash"
+)
+
+// BackendSelector values understood by Route.BackendSelector, selecting
+// how a non-sticky (or sticky-miss) request picks a backend among those
+// not pinned by stickiness. Left empty, BackendSelectorLeastInflight is
+// used.
+const (
+	// BackendSelectorLeastInflight orders backends by ascending
+	// in-flight request count; this was the proxy's original (and
+	// still default) behavior.
+	BackendSelectorLeastInflight = "least_inflight"
+	// BackendSelectorP2C samples two random backends and picks the one
+	// with fewer in-flight requests, approximating least-loaded
+	// selection without sorting every backend on every request.
+	BackendSelectorP2C = "p2c"
+	// BackendSelectorEWMA biases selection toward backends with a
+	// lower exponentially-weighted moving average response time,
+	// combined with in-flight count to avoid herding onto a backend
+	// the moment it looks fast.
+	BackendSelectorEWMA = "ewma"
+)
+
+// StickyCookie configures the affinity cookie the proxy sets when a
+// route's Sticky field is enabled. Every field is optional; the proxy's
+// prior, hardcoded behavior is preserved as the default for each one.
+// It is only consulted under StickinessModeDuration.
+type StickyCookie struct {
+	// Name overrides the cookie's name. Left empty, it defaults to
+	// "_backend".
+	Name string `json:"name,omitempty"`
+	// Path overrides the cookie's Path attribute. Left empty, it
+	// defaults to "/".
+	Path string `json:"path,omitempty"`
+	// Domain sets the cookie's Domain attribute. Left empty, the
+	// cookie is scoped to the exact host that set it.
+	Domain string `json:"domain,omitempty"`
+	// MaxAge sets the cookie's MaxAge, in seconds. Left zero, the
+	// cookie is a session cookie with no fixed expiry.
+	MaxAge int `json:"max_age,omitempty"`
+	// Secure overrides whether the cookie is marked Secure. Left nil,
+	// it defaults to true for requests served over TLS and false
+	// otherwise.
+	Secure *bool `json:"secure,omitempty"`
+	// HTTPOnly overrides whether the cookie is marked HttpOnly. Left
+	// nil, it defaults to true.
+	HTTPOnly *bool `json:"http_only,omitempty"`
+	// SameSite overrides the cookie's SameSite attribute; one of the
+	// StickyCookieSameSite* constants. Left empty, it defaults to
+	// StickyCookieSameSiteLax.
+	SameSite string `json:"same_site,omitempty"`
+}
+
+// Route is the generic, wire-format representation of a route. Only the
+// fields relevant to Type are populated by the router; the rest are left
+// at their zero value.
+type Route struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+
+	ParentRef string `json:"parent_ref,omitempty"`
+	Service   string `json:"service"`
+	Leader    bool   `json:"leader,omitempty"`
+
+	// HTTP-specific fields.
+	Domain       string        `json:"domain,omitempty"`
+	Certificate  *Certificate  `json:"certificate,omitempty"`
+	Sticky       bool          `json:"sticky,omitempty"`
+	StickyCookie *StickyCookie `json:"sticky_cookie,omitempty"`
+	// StickinessMode selects how Sticky pins requests to a backend; see
+	// the StickinessMode* constants. Left empty, StickinessModeDuration
+	// is used.
+	StickinessMode string `json:"stickiness_mode,omitempty"`
+	// ApplicationCookieName names the backend-set cookie consulted
+	// under StickinessModeApplicationCookie. Left empty, it defaults to
+	// "JSESSIONID".
+	ApplicationCookieName string `json:"application_cookie_name,omitempty"`
+	// HashKey selects the request value hashed under
+	// StickinessModeConsistentHash: "client_ip" (the default),
+	// "header:<Name>", or "cookie:<name>", the same syntax as
+	// RateLimit.ExtractorKey.
+	HashKey           string      `json:"hash_key,omitempty"`
+	Path              string      `json:"path,omitempty"`
+	DisableKeepAlives bool        `json:"disable_keep_alives,omitempty"`
+	RateLimits        []RateLimit `json:"rate_limits,omitempty"`
+	Match             *Match      `json:"match,omitempty"`
+	BackendTLS        *BackendTLS `json:"backend_tls,omitempty"`
+	// TrustForwardHeader makes the router trust this route's client-
+	// supplied X-Forwarded-*/Forwarded headers even if its peer isn't
+	// one of the listener's TrustedProxies, for routes fed by a
+	// forwarder the listener's CIDR list can't describe (e.g. a Unix
+	// socket or a load balancer with a rotating address).
+	TrustForwardHeader bool `json:"trust_forward_header,omitempty"`
+	// ForwardedHeaders, if set to ForwardedHeadersStrip, removes
+	// X-Forwarded-*/Forwarded/X-Request-Id instead of setting them, for
+	// backends that must never see how (or whether) a request passed
+	// through the router. Left empty, headers are set per the trust
+	// policy described by TrustedProxies/TrustForwardHeader.
+	ForwardedHeaders string `json:"forwarded_headers,omitempty"`
+	// BackendProtocol selects the protocol used to proxy to this
+	// route's backends: BackendProtocolHTTP1 (the default),
+	// BackendProtocolH2 or BackendProtocolH2C. It has no effect on
+	// Upgrade requests, which are always tunnelled to the backend as
+	// raw HTTP/1.1 regardless of this setting.
+	BackendProtocol string `json:"backend_protocol,omitempty"`
+	// ConnectTimeout bounds how long dialing a backend may take. Left
+	// zero, it defaults to 10 seconds.
+	ConnectTimeout time.Duration `json:"connect_timeout,omitempty"`
+	// ResponseHeaderTimeout bounds how long the router waits for a
+	// backend's response headers once the request has been written to
+	// it. Left zero, there is no timeout.
+	ResponseHeaderTimeout time.Duration `json:"response_header_timeout,omitempty"`
+	// IdleTimeout bounds how long an idle keep-alive connection to a
+	// backend is kept open before being closed. Left zero, there is no
+	// timeout.
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+	// CircuitBreaker, left nil, disables per-backend-instance circuit
+	// breaking for this route.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+	// BackendSelector chooses among this route's non-pinned backends;
+	// see the BackendSelector* constants. Left empty,
+	// BackendSelectorLeastInflight is used.
+	BackendSelector string `json:"backend_selector,omitempty"`
+	// DrainTimeout bounds how long a deregistered backend keeps serving
+	// requests already pinned to it by a sticky cookie, instead of
+	// disappearing the moment discoverd stops reporting it. Non-sticky
+	// traffic stops being routed to it immediately regardless. Left
+	// zero, a deregistered backend is removed with no grace period.
+	DrainTimeout time.Duration `json:"drain_timeout,omitempty"`
+
+	// TCP-specific fields.
+	Port int32 `json:"port,omitempty"`
+
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// HTTPRoute is a convenience view of Route for building/reading HTTP
+// routes without having to know about TCP-only fields.
+type HTTPRoute struct {
+	ID        string
+	ParentRef string
+	Service   string
+	Leader    bool
+
+	Domain                string
+	Certificate           *Certificate
+	Sticky                bool
+	StickyCookie          *StickyCookie
+	StickinessMode        string
+	ApplicationCookieName string
+	HashKey               string
+	Path                  string
+	DisableKeepAlives     bool
+	RateLimits            []RateLimit
+	Match                 *Match
+	BackendTLS            *BackendTLS
+
+	TrustForwardHeader bool
+	ForwardedHeaders   string
+	BackendProtocol    string
+
+	ConnectTimeout        time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleTimeout           time.Duration
+	CircuitBreaker        *CircuitBreaker
+	BackendSelector       string
+	DrainTimeout          time.Duration
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// TCPRoute is a convenience view of Route for building/reading TCP routes.
+type TCPRoute struct {
+	ID        string
+	ParentRef string
+	Service   string
+	Leader    bool
+	Port      int32
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ToRoute converts h into its wire representation.
+func (h HTTPRoute) ToRoute() *Route {
+	return &Route{
+		Type:                  RouteTypeHTTP,
+		ID:                    h.ID,
+		ParentRef:             h.ParentRef,
+		Service:               h.Service,
+		Leader:                h.Leader,
+		Domain:                h.Domain,
+		Certificate:           h.Certificate,
+		Sticky:                h.Sticky,
+		StickyCookie:          h.StickyCookie,
+		StickinessMode:        h.StickinessMode,
+		ApplicationCookieName: h.ApplicationCookieName,
+		HashKey:               h.HashKey,
+		Path:                  h.Path,
+		DisableKeepAlives:     h.DisableKeepAlives,
+		RateLimits:            h.RateLimits,
+		Match:                 h.Match,
+		BackendTLS:            h.BackendTLS,
+		TrustForwardHeader:    h.TrustForwardHeader,
+		ForwardedHeaders:      h.ForwardedHeaders,
+		BackendProtocol:       h.BackendProtocol,
+		ConnectTimeout:        h.ConnectTimeout,
+		ResponseHeaderTimeout: h.ResponseHeaderTimeout,
+		IdleTimeout:           h.IdleTimeout,
+		CircuitBreaker:        h.CircuitBreaker,
+		BackendSelector:       h.BackendSelector,
+		DrainTimeout:          h.DrainTimeout,
+	}
+}
+
+// ToRoute converts t into its wire representation.
+func (t TCPRoute) ToRoute() *Route {
+	return &Route{
+		Type:      RouteTypeTCP,
+		ID:        t.ID,
+		ParentRef: t.ParentRef,
+		Service:   t.Service,
+		Leader:    t.Leader,
+		Port:      t.Port,
+	}
+}
+
+// HTTPRoute returns the HTTP view of r. It panics if r is not an HTTP
+// route, the same way FromRoute helpers in this package always assume
+// the caller has already checked Type.
+func (r *Route) HTTPRoute() *HTTPRoute {
+	if r.Type != RouteTypeHTTP {
+		panic(fmt.Sprintf("router: not an HTTP route: %s", r.Type))
+	}
+	return &HTTPRoute{
+		ID:                    r.ID,
+		ParentRef:             r.ParentRef,
+		Service:               r.Service,
+		Leader:                r.Leader,
+		Domain:                r.Domain,
+		Certificate:           r.Certificate,
+		Sticky:                r.Sticky,
+		StickyCookie:          r.StickyCookie,
+		StickinessMode:        r.StickinessMode,
+		ApplicationCookieName: r.ApplicationCookieName,
+		HashKey:               r.HashKey,
+		Path:                  r.Path,
+		DisableKeepAlives:     r.DisableKeepAlives,
+		RateLimits:            r.RateLimits,
+		Match:                 r.Match,
+		BackendTLS:            r.BackendTLS,
+		TrustForwardHeader:    r.TrustForwardHeader,
+		ForwardedHeaders:      r.ForwardedHeaders,
+		BackendProtocol:       r.BackendProtocol,
+		ConnectTimeout:        r.ConnectTimeout,
+		ResponseHeaderTimeout: r.ResponseHeaderTimeout,
+		IdleTimeout:           r.IdleTimeout,
+		CircuitBreaker:        r.CircuitBreaker,
+		BackendSelector:       r.BackendSelector,
+		DrainTimeout:          r.DrainTimeout,
+	}
+}
+
+// TCPRoute returns the TCP view of r.
+func (r *Route) TCPRoute() *TCPRoute {
+	if r.Type != RouteTypeTCP {
+		panic(fmt.Sprintf("router: not a TCP route: %s", r.Type))
+	}
+	return &TCPRoute{
+		ID:        r.ID,
+		ParentRef: r.ParentRef,
+		Service:   r.Service,
+		Leader:    r.Leader,
+		Port:      r.Port,
+	}
+}
+
+// Backend is a single instance of a service that a route may be load
+// balanced across.
+type Backend struct {
+	Addr    string
+	JobID   string
+	Drained bool
+}
+
+// Event is emitted by a Syncer whenever the set of routes it is watching
+// changes.
+type Event struct {
+	Event string
+	ID    string
+	Error error
+	Route *Route
+}